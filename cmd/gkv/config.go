@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net"
+	"os"
+	"strings"
+)
+
+// config holds the agent settings.
+// It may be loaded from a JSON file, with flags taking precedence.
+type config struct {
+	Mesh     string   `json:"mesh"`
+	Name     string   `json:"name"`
+	NickName string   `json:"nickname"`
+	Peers    []string `json:"peers"`
+	Password string   `json:"password"`
+	HTTP     string   `json:"http"`
+	DataDir  string   `json:"data_dir"`
+	Codec    string   `json:"codec"`
+	TTL      int      `json:"ttl"`
+	Adaptive bool     `json:"adaptive_ttl"`
+}
+
+type stringset map[string]struct{}
+
+func (ss stringset) Set(value string) error {
+	ss[value] = struct{}{}
+	return nil
+}
+
+func (ss stringset) String() string {
+	return strings.Join(ss.slice(), ",")
+}
+
+func (ss stringset) slice() []string {
+	slice := make([]string, 0, len(ss))
+	for k := range ss {
+		slice = append(slice, k)
+	}
+	return slice
+}
+
+// loadConfig reads the JSON config file at path.
+func loadConfig(path string, cfg *config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(cfg)
+}
+
+// override copies every flag set on the command line into cfg.
+func override(fs *flag.FlagSet, cfg *config, flags *config) {
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "mesh":
+			cfg.Mesh = flags.Mesh
+		case "name":
+			cfg.Name = flags.Name
+		case "nickname":
+			cfg.NickName = flags.NickName
+		case "peer":
+			cfg.Peers = flags.Peers
+		case "password":
+			cfg.Password = flags.Password
+		case "http":
+			cfg.HTTP = flags.HTTP
+		case "data":
+			cfg.DataDir = flags.DataDir
+		case "codec":
+			cfg.Codec = flags.Codec
+		case "ttl":
+			cfg.TTL = flags.TTL
+		case "adaptive-ttl":
+			cfg.Adaptive = flags.Adaptive
+		}
+	})
+}
+
+// hardwareAddr returns the first usable MAC address, for use as a default
+// peer name.
+func hardwareAddr() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		if s := iface.HardwareAddr.String(); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return h
+}
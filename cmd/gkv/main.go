@@ -0,0 +1,131 @@
+// Command gkv runs a gkv node as a standalone agent, optionally serving
+// the HTTP API, until it receives SIGINT or SIGTERM.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/AlexRudd/gkv"
+	"github.com/weaveworks/mesh"
+)
+
+func main() {
+	peers := stringset{}
+	var (
+		configPath = flag.String("config", "", "JSON config file; flags override its settings")
+		flags      = config{}
+	)
+	flag.StringVar(&flags.Mesh, "mesh", net.JoinHostPort("0.0.0.0", strconv.Itoa(mesh.Port)), "mesh listen address")
+	flag.StringVar(&flags.Name, "name", hardwareAddr(), "peer name (MAC address format)")
+	flag.StringVar(&flags.NickName, "nickname", hostname(), "peer nickname")
+	flag.Var(peers, "peer", "initial peer (may be repeated)")
+	flag.StringVar(&flags.Password, "password", "", "password to encrypt mesh traffic (default $GKV_PASSWORD)")
+	flag.StringVar(&flags.HTTP, "http", "", "HTTP API listen address, empty to disable")
+	flag.StringVar(&flags.DataDir, "data", "", "directory to persist state in, empty to disable")
+	flag.StringVar(&flags.Codec, "codec", "json", "gossip wire codec: json or binary")
+	flag.IntVar(&flags.TTL, "ttl", gkv.DefaultTTL, "hop count of gossiped deltas")
+	flag.BoolVar(&flags.Adaptive, "adaptive-ttl", false, "derive the hop count from the cluster size, with -ttl as a floor")
+	flag.Parse()
+	flags.Peers = peers.slice()
+	// read only now, so -h does not print it as the default
+	if flags.Password == "" {
+		flags.Password = os.Getenv("GKV_PASSWORD")
+	}
+
+	logger := log.New(os.Stderr, "gkv> ", log.LstdFlags)
+
+	cfg := flags
+	if *configPath != "" {
+		if err := loadConfig(*configPath, &cfg); err != nil {
+			logger.Fatalf("config: %s: %v", *configPath, err)
+		}
+		override(flag.CommandLine, &cfg, &flags)
+	}
+
+	host, portStr, err := net.SplitHostPort(cfg.Mesh)
+	if err != nil {
+		logger.Fatalf("mesh address: %s: %v", cfg.Mesh, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		logger.Fatalf("mesh address: %s: %v", cfg.Mesh, err)
+	}
+	name, err := mesh.PeerNameFromUserInput(cfg.Name)
+	if err != nil {
+		logger.Fatalf("peer name: %s: %v", cfg.Name, err)
+	}
+	var codec gkv.Codec
+	switch cfg.Codec {
+	case "", "json":
+		codec = gkv.JSONCodec
+	case "binary":
+		codec = gkv.BinaryCodec
+	default:
+		logger.Fatalf("codec: unknown codec %q", cfg.Codec)
+	}
+	var password []byte
+	if cfg.Password != "" {
+		password = []byte(cfg.Password)
+	}
+
+	node, err := gkv.New(gkv.Config{
+		Name:     name,
+		NickName: cfg.NickName,
+		Host:     host,
+		Port:     port,
+		Password: password,
+		Logger:   logger,
+		DataDir:  cfg.DataDir,
+		Codec:    codec,
+		TTL: gkv.TTLPolicy{
+			Update:   cfg.TTL,
+			Repair:   cfg.TTL,
+			Request:  cfg.TTL,
+			Ack:      cfg.TTL,
+			Adaptive: cfg.Adaptive,
+		},
+	})
+	if err != nil {
+		logger.Fatalf("Could not create node: %v", err)
+	}
+	logger.Printf("Mesh listening on %s as %s (%s)", cfg.Mesh, name, cfg.NickName)
+	node.Start()
+	if len(cfg.Peers) > 0 {
+		node.Connect(cfg.Peers...)
+	}
+
+	var srv *http.Server
+	if cfg.HTTP != "" {
+		srv = &http.Server{Addr: cfg.HTTP, Handler: gkv.NewHandler(node)}
+		go func() {
+			logger.Printf("HTTP API listening on %s", cfg.HTTP)
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Printf("HTTP API: %v", err)
+			}
+		}()
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	logger.Printf("Received %v, leaving", <-c)
+
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Printf("HTTP API shutdown: %v", err)
+		}
+		cancel()
+	}
+	if err := node.Stop(); err != nil {
+		logger.Fatalf("Could not stop node: %v", err)
+	}
+}
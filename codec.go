@@ -0,0 +1,330 @@
+package gkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Codec selects how gossip is encoded for the wire: JSONCodec or
+// BinaryCodec. Everything a codec encodes starts with its version byte,
+// the Codec's own value, so a peer can decode gossip from either codec
+// whichever one it sends with itself. This lets a cluster be rolled over
+// from one codec to another.
+type Codec byte
+
+const (
+	// JSONCodec encodes gossip as JSON, as every version of gkv
+	// understands. It needs no version byte of its own: JSON objects
+	// begin with '{'.
+	JSONCodec Codec = '{'
+	// BinaryCodec encodes gossip compactly, using length-prefixed,
+	// varint encoded fields.
+	BinaryCodec Codec = 1
+)
+
+// Version is the first byte of every encoding.
+func (c Codec) Version() byte {
+	return byte(c)
+}
+
+// encode cs with codec c.
+func (c Codec) encode(cs *clusterState) ([]byte, error) {
+	switch c {
+	case JSONCodec:
+		return json.Marshal(cs)
+	case BinaryCodec:
+		return encodeBinary(cs)
+	}
+	return nil, fmt.Errorf("unknown codec version %v", byte(c))
+}
+
+// decode buf using the codec named by its version byte.
+func decode(buf []byte, cs *clusterState) error {
+	if len(buf) == 0 {
+		return errors.New("empty gossip")
+	}
+	switch Codec(buf[0]) {
+	case JSONCodec:
+		return json.Unmarshal(buf, cs)
+	case BinaryCodec:
+		return decodeBinary(buf, cs)
+	}
+	return fmt.Errorf("unknown codec version %v", buf[0])
+}
+
+// flags packed into one byte per delta or value
+const (
+	flagFix = 1 << iota
+	flagAck
+	flagDeleted
+	flagSuperseded
+	flagGone
+	flagStamped
+	flagObserved
+	flagPrior
+)
+
+type binaryWriter struct {
+	bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (w *binaryWriter) uvarint(v uint64) {
+	w.Write(w.scratch[:binary.PutUvarint(w.scratch[:], v)])
+}
+
+func (w *binaryWriter) varint(v int64) {
+	w.Write(w.scratch[:binary.PutVarint(w.scratch[:], v)])
+}
+
+func (w *binaryWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *binaryWriter) value(vi valueInstance) {
+	var flags byte
+	if vi.D {
+		flags |= flagDeleted
+	}
+	if vi.T != 0 {
+		flags |= flagStamped
+	}
+	if len(vi.O) > 0 {
+		flags |= flagObserved
+	}
+	w.WriteByte(flags)
+	w.varint(int64(vi.C))
+	w.string(vi.V)
+	w.varint(vi.E)
+	if vi.T != 0 {
+		w.varint(int64(vi.T))
+	}
+	if len(vi.O) > 0 {
+		w.uvarint(uint64(len(vi.O)))
+		for _, t := range vi.O {
+			w.uvarint(uint64(t.P))
+			w.varint(t.I)
+			w.varint(int64(t.C))
+		}
+	}
+}
+
+// encodeBinary encodes cs with BinaryCodec.
+func encodeBinary(cs *clusterState) ([]byte, error) {
+	w := &binaryWriter{}
+	w.WriteByte(BinaryCodec.Version())
+	w.uvarint(uint64(len(cs.Deltas)))
+	for _, d := range cs.Deltas {
+		var flags byte
+		if d.Fix {
+			flags |= flagFix
+		}
+		if d.Ack {
+			flags |= flagAck
+		}
+		if d.Sup {
+			flags |= flagSuperseded
+		}
+		if d.Gone {
+			flags |= flagGone
+		}
+		if len(d.Prior) > 0 {
+			flags |= flagPrior
+		}
+		w.WriteByte(flags)
+		w.uvarint(uint64(d.P))
+		w.varint(int64(d.Ttl))
+		w.string(d.K)
+		w.value(d.Vi)
+		w.varint(d.I)
+		w.uvarint(uint64(d.S))
+		w.varint(int64(d.To))
+		if len(d.Prior) > 0 {
+			w.uvarint(uint64(len(d.Prior)))
+			for _, c := range d.Prior {
+				w.varint(int64(c))
+			}
+		}
+	}
+	// sorted, so encoding is deterministic
+	peers := make([]mesh.PeerName, 0, len(cs.States))
+	for p := range cs.States {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	w.uvarint(uint64(len(peers)))
+	for _, p := range peers {
+		s := cs.States[p]
+		w.uvarint(uint64(p))
+		w.varint(s.Incarnation)
+		w.varint(int64(s.Clock))
+		w.string(s.From)
+		w.string(s.To)
+		w.uvarint(uint64(len(s.Missed)))
+		for _, r := range s.Missed {
+			w.varint(int64(r[0]))
+			w.varint(int64(r[1]))
+		}
+		keys := make([]string, 0, len(s.Set))
+		for k := range s.Set {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.uvarint(uint64(len(keys)))
+		for _, k := range keys {
+			w.string(k)
+			w.value(s.Set[k])
+		}
+	}
+	return w.Bytes(), nil
+}
+
+type binaryReader struct {
+	*bytes.Reader
+	err error
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(r)
+	r.err = err
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(r)
+	r.err = err
+	return v
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	b, err := r.ReadByte()
+	r.err = err
+	return b
+}
+
+// length reads a count, checking it against what is left to read so a
+// corrupt message can't make us allocate wildly.
+func (r *binaryReader) length() int {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(r.Len()) {
+		r.err = io.ErrUnexpectedEOF
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) string() string {
+	n := r.length()
+	if n == 0 {
+		return ""
+	}
+	b := make([]byte, n)
+	_, r.err = io.ReadFull(r, b)
+	return string(b)
+}
+
+func (r *binaryReader) value() valueInstance {
+	flags := r.byte()
+	vi := valueInstance{
+		D: flags&flagDeleted != 0,
+		C: int(r.varint()),
+		V: r.string(),
+		E: r.varint(),
+	}
+	if flags&flagStamped != 0 {
+		vi.T = Timestamp(r.varint())
+	}
+	if flags&flagObserved != 0 {
+		n := r.length()
+		vi.O = make([]writeTag, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			vi.O = append(vi.O, writeTag{
+				P: mesh.PeerName(r.uvarint()),
+				I: r.varint(),
+				C: int(r.varint()),
+			})
+		}
+	}
+	return vi
+}
+
+// decodeBinary decodes buf, encoded with BinaryCodec, into cs.
+func decodeBinary(buf []byte, cs *clusterState) error {
+	r := &binaryReader{Reader: bytes.NewReader(buf)}
+	if v := r.byte(); v != BinaryCodec.Version() {
+		return fmt.Errorf("not binary codec version %v", v)
+	}
+	if n := r.length(); n > 0 {
+		cs.Deltas = make([]delta, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			flags := r.byte()
+			cs.Deltas = append(cs.Deltas, delta{
+				Fix:  flags&flagFix != 0,
+				Ack:  flags&flagAck != 0,
+				Sup:  flags&flagSuperseded != 0,
+				Gone: flags&flagGone != 0,
+				P:    mesh.PeerName(r.uvarint()),
+				Ttl:  int(r.varint()),
+				K:    r.string(),
+				Vi:   r.value(),
+				I:    r.varint(),
+				S:    mesh.PeerName(r.uvarint()),
+				To:   int(r.varint()),
+			})
+			if flags&flagPrior != 0 {
+				d := &cs.Deltas[len(cs.Deltas)-1]
+				n := r.length()
+				d.Prior = make([]int, 0, n)
+				for j := 0; j < n && r.err == nil; j++ {
+					d.Prior = append(d.Prior, int(r.varint()))
+				}
+			}
+		}
+	}
+	if n := r.length(); n > 0 {
+		cs.States = make(map[mesh.PeerName]*nodeSnapshot, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			p := mesh.PeerName(r.uvarint())
+			s := &nodeSnapshot{
+				Incarnation: r.varint(),
+				Clock:       int(r.varint()),
+				From:        r.string(),
+				To:          r.string(),
+			}
+			if m := r.length(); m > 0 {
+				s.Missed = make([][2]int, 0, m)
+				for j := 0; j < m && r.err == nil; j++ {
+					s.Missed = append(s.Missed, [2]int{int(r.varint()), int(r.varint())})
+				}
+			}
+			if m := r.length(); m > 0 {
+				s.Set = make(map[string]valueInstance, m)
+				for j := 0; j < m && r.err == nil; j++ {
+					k := r.string()
+					s.Set[k] = r.value()
+				}
+			}
+			cs.States[p] = s
+		}
+	}
+	return r.err
+}
@@ -0,0 +1,84 @@
+package gkv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/weaveworks/mesh"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		description string
+		in          clusterState
+	}{
+		{
+			"empty clusterState",
+			clusterState{},
+		},
+		{
+			"update, coalesced update, tombstone, repair request, ack, superseded and gone deltas",
+			clusterState{Deltas: []delta{
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 1, V: "v1", E: 1500000000, T: 1400000000}, I: 7},
+				delta{P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 2, D: true, O: []writeTag{writeTag{P: 124, I: 3, C: 5}}}, I: 7},
+				delta{Fix: true, P: 124, Ttl: 1, Vi: valueInstance{C: 9}, I: -1, To: 12},
+				delta{Ack: true, P: 123, S: 124, Ttl: 3, K: "k1", Vi: valueInstance{C: 2}, I: 7},
+				delta{Sup: true, P: 123, Ttl: 3, Vi: valueInstance{C: 1}, I: 7},
+				delta{Gone: true, P: 125, Ttl: 3, I: 4},
+				delta{P: 123, Ttl: 3, K: "k3", Vi: valueInstance{C: 9, V: "v9"}, Prior: []int{4, 6}},
+			}},
+		},
+		{
+			"complete states",
+			clusterState{States: map[mesh.PeerName]*nodeSnapshot{
+				123: &nodeSnapshot{
+					Incarnation: 7,
+					Clock:       5,
+					Missed:      [][2]int{{2, 2}, {4, 4}},
+					Set: map[string]valueInstance{
+						"k1": valueInstance{C: 5, V: "v5"},
+						"k2": valueInstance{C: 3, D: true},
+					},
+				},
+				124: &nodeSnapshot{Clock: 0},
+			}},
+		},
+	} {
+		for _, c := range []Codec{JSONCodec, BinaryCodec} {
+			b, err := c.encode(&tc.in)
+			if err != nil {
+				t.Fatalf("%s: encode: %v", tc.description, err)
+			}
+			if b[0] != c.Version() {
+				t.Errorf("Failed test for: %s (codec %v version byte %v)", tc.description, c.Version(), b[0])
+			}
+			out := clusterState{}
+			if err := decode(b, &out); err != nil {
+				t.Fatalf("%s: decode: %v", tc.description, err)
+			}
+			if !reflect.DeepEqual(out, tc.in) {
+				t.Errorf("Failed test for: %s (codec %v round trip)", tc.description, c.Version())
+				t.Errorf("Check decode() failed:\nWanted: %s\nGot: %s", spew.Sdump(tc.in), spew.Sdump(out))
+			} else {
+				t.Logf("Passed test for: %s (codec %v round trip)", tc.description, c.Version())
+			}
+		}
+	}
+}
+
+func TestCodecDecodeInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		description string
+		in          []byte
+	}{
+		{"empty", []byte{}},
+		{"unknown version", []byte{0xff}},
+		{"truncated binary", []byte{1, 1, 0, 246, 0}},
+		{"oversized binary length", []byte{1, 0xff, 0xff, 0x03}},
+	} {
+		if err := decode(tc.in, &clusterState{}); err == nil {
+			t.Errorf("Failed test for: %s (decode() should fail)", tc.description)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package gkv
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Keys starting with internalPrefix hold state built on top of the key
+// space, such as counters and sets. They replicate like any other key, but are
+// hidden from Keys, ModifiedSince and watchers.
+const internalPrefix = "\x00"
+
+// counterPrefix starts the key each node keeps its slot of a counter in.
+const counterPrefix = internalPrefix + "counter/"
+
+// internal reports whether key holds internal state.
+func internal(key string) bool {
+	return strings.HasPrefix(key, internalPrefix)
+}
+
+// counts are the totals added to and taken away from a counter.
+type counts struct {
+	inc, dec uint64
+}
+
+// max returns the larger of each total in c and o. Totals only grow, so
+// this is the later of two readings of the same counts.
+func (c counts) max(o counts) counts {
+	if o.inc > c.inc {
+		c.inc = o.inc
+	}
+	if o.dec > c.dec {
+		c.dec = o.dec
+	}
+	return c
+}
+
+// counterSlot is one node's share of a counter: the total it has added,
+// and the total it has taken away. Only the owning node changes its
+// slot, and only ever upwards, so the newest write of it is always right.
+// A slot also keeps the counts of the lives of other nodes whose state
+// this node has dropped, by restart or purge, so they are not lost.
+type counterSlot struct {
+	counts
+	kept map[writer]counts
+}
+
+func (s counterSlot) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d,%d", s.inc, s.dec)
+	ws := make([]writer, 0, len(s.kept))
+	for w := range s.kept {
+		ws = append(ws, w)
+	}
+	sort.Slice(ws, func(i, j int) bool {
+		if ws[i].p != ws[j].p {
+			return ws[i].p < ws[j].p
+		}
+		return ws[i].i < ws[j].i
+	})
+	for _, w := range ws {
+		c := s.kept[w]
+		fmt.Fprintf(&b, ";%d,%d,%d,%d", uint64(w.p), w.i, c.inc, c.dec)
+	}
+	return b.String()
+}
+
+func parseCounterSlot(v string) (counterSlot, error) {
+	var s counterSlot
+	parts := strings.Split(v, ";")
+	if _, err := fmt.Sscanf(parts[0], "%d,%d", &s.inc, &s.dec); err != nil {
+		return s, err
+	}
+	for _, part := range parts[1:] {
+		var p uint64
+		var w writer
+		var c counts
+		if _, err := fmt.Sscanf(part, "%d,%d,%d,%d", &p, &w.i, &c.inc, &c.dec); err != nil {
+			return s, err
+		}
+		w.p = mesh.PeerName(p)
+		if s.kept == nil {
+			s.kept = map[writer]counts{}
+		}
+		s.kept[w] = c
+	}
+	return s, nil
+}
+
+// counterSlot returns the slot of counter key held by node p.
+// Must be called with the read lock held.
+func (cs *clusterState) counterSlot(p mesh.PeerName, key string) counterSlot {
+	vi := cs.nodes[p].set[key]
+	if vi == nil || vi.D {
+		return counterSlot{}
+	}
+	s, err := parseCounterSlot(vi.V)
+	if err != nil {
+		cs.logger.Printf("Bad counter slot: %v->%v: %v", p, key, err)
+	}
+	return s
+}
+
+// slot returns our own slot of counter name.
+// Must be called with the read lock held.
+func (cs *clusterState) slot(name string) counterSlot {
+	return cs.counterSlot(cs.self, counterPrefix+name)
+}
+
+// keepCounters carries the counter slots of ns, whose state is about to
+// be dropped, on in our own slots. Must be called with the write lock
+// held.
+func (cs *clusterState) keepCounters(ns *nodeState) {
+	for k := range ns.set {
+		if !strings.HasPrefix(k, counterPrefix) {
+			continue
+		}
+		theirs := cs.counterSlot(ns.self, k)
+		ours := cs.counterSlot(cs.self, k)
+		self := writer{cs.self, cs.nodes[cs.self].incarnation}
+		changed := false
+		keep := func(w writer, c counts) {
+			if w == self || c == (counts{}) {
+				return
+			}
+			if ours.kept == nil {
+				ours.kept = map[writer]counts{}
+			}
+			if m := ours.kept[w].max(c); m != ours.kept[w] {
+				ours.kept[w] = m
+				changed = true
+			}
+		}
+		keep(writer{ns.self, ns.incarnation}, theirs.counts)
+		for w, c := range theirs.kept {
+			keep(w, c)
+		}
+		if changed {
+			cs.logger.Printf("Keeping counter slot of dropped node: %v->%v", ns.self, k)
+			cs.write(k, ours.String(), 0)
+		}
+	}
+}
+
+// Incr adds n to counter name. Used alone, Incr makes a grow-only
+// counter (G-Counter).
+func (cs *clusterState) Incr(name string, n uint64) {
+	cs.update(func() error {
+		s := cs.slot(name)
+		s.inc += n
+		cs.write(counterPrefix+name, s.String(), 0)
+		return nil
+	})
+}
+
+// Decr takes n from counter name, making it a PN-Counter.
+func (cs *clusterState) Decr(name string, n uint64) {
+	cs.update(func() error {
+		s := cs.slot(name)
+		s.dec += n
+		cs.write(counterPrefix+name, s.String(), 0)
+		return nil
+	})
+}
+
+// Value returns the value of counter name: everything added to it, less
+// everything taken away, by every life of every node. The counts of lives
+// whose state has been dropped are kept by the nodes that dropped it.
+func (cs *clusterState) Value(name string) int64 {
+	// get read lock
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+	// a life's counts may be held by several nodes; the highest are right
+	all := map[writer]counts{}
+	for p, ns := range cs.nodes {
+		s := cs.counterSlot(p, counterPrefix+name)
+		w := writer{p, ns.incarnation}
+		all[w] = all[w].max(s.counts)
+		for w, c := range s.kept {
+			all[w] = all[w].max(c)
+		}
+	}
+	var v int64
+	for _, c := range all {
+		v += int64(c.inc) - int64(c.dec)
+	}
+	return v
+}
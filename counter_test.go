@@ -0,0 +1,113 @@
+package gkv
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestStateCounter(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	a := newClusterState(1, logger)
+	b := newClusterState(2, logger)
+	exchange := func() {
+		if d := a.takeDeltas(); d != nil {
+			b.Merge(d)
+		}
+		if d := b.takeDeltas(); d != nil {
+			a.Merge(d)
+		}
+	}
+
+	for _, tc := range []struct {
+		description string
+		op          func()
+		want        int64
+	}{
+		{"increments on one node", func() { a.Incr("c", 3); a.Incr("c", 2) }, 5},
+		{"increments on both nodes", func() { b.Incr("c", 4) }, 9},
+		{"decrement", func() { a.Decr("c", 7) }, 2},
+		{"concurrent changes", func() { a.Incr("c", 1); b.Decr("c", 5) }, -2},
+		{"other counters untouched", func() { b.Incr("d", 1) }, -2},
+	} {
+		tc.op()
+		exchange()
+		if va, vb := a.Value("c"), b.Value("c"); va != tc.want || vb != tc.want {
+			t.Errorf("Failed test for: %s (Value())", tc.description)
+			t.Errorf("Check Value() failed:\nWanted: %v\nGot: %v %v", tc.want, va, vb)
+		} else {
+			t.Logf("Passed test for: %s (Value())", tc.description)
+		}
+	}
+	if v := a.Value("missing"); v != 0 {
+		t.Errorf("Check Value() failed: missing counter is %v", v)
+	}
+	if kvs, _ := a.Keys(2); len(kvs) != 0 {
+		t.Errorf("Check Keys() failed: counter slots visible: %v", kvs)
+	}
+	a.Set(counterPrefix+"c", "100,0")
+	if err := a.Delete(counterPrefix + "c"); err != ErrReservedKey || a.Value("c") != -2 {
+		t.Errorf("Check reserved keys failed: %v, counter is %v", err, a.Value("c"))
+	}
+	key := counterPrefix + "c"
+	if _, err := a.Get(1, key); err != ErrKeyNotFound {
+		t.Errorf("Check Get() failed: reserved key read: %v", err)
+	}
+	if _, err := a.GetAny(key); err != ErrKeyNotFound {
+		t.Errorf("Check GetAny() failed: reserved key read: %v", err)
+	}
+	if _, err := a.GetResolved(key, nil); err != ErrKeyNotFound {
+		t.Errorf("Check GetResolved() failed: reserved key read: %v", err)
+	}
+	if _, err := a.GetValues(key); err != ErrKeyNotFound {
+		t.Errorf("Check GetValues() failed: reserved key read: %v", err)
+	}
+}
+
+func TestStateCounterDroppedNodes(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	a := newClusterState(1, logger)
+	b := newClusterState(2, logger)
+	exchange := func(x, y *clusterState) {
+		if d := x.takeDeltas(); d != nil {
+			y.Merge(d)
+		}
+		if d := y.takeDeltas(); d != nil {
+			x.Merge(d)
+		}
+	}
+	a.Incr("c", 5)
+	b.Incr("c", 3)
+	b.Decr("c", 1)
+	exchange(a, b)
+
+	for _, tc := range []struct {
+		description string
+		op          func()
+		want        int64
+	}{
+		{"node restarts without its state", func() {
+			restarted := newClusterState(2, logger)
+			restarted.nodes[2].incarnation = b.nodes[2].incarnation + 1
+			b = restarted
+			b.Incr("c", 4)
+			// a keeps the slot of b's previous life, and gossips it back
+			exchange(a, b)
+			exchange(a, b)
+		}, 11},
+		{"restarted node counts on", func() { b.Incr("c", 1); exchange(a, b) }, 12},
+		{"node purged after departing", func() {
+			a.purge(2, b.nodes[2].incarnation)
+			b = newClusterState(3, logger)
+			exchange(a, b)
+		}, 12},
+	} {
+		tc.op()
+		if va, vb := a.Value("c"), b.Value("c"); va != tc.want || vb != tc.want {
+			t.Errorf("Failed test for: %s (Value())", tc.description)
+			t.Errorf("Check Value() failed:\nWanted: %v\nGot: %v %v", tc.want, va, vb)
+		} else {
+			t.Logf("Passed test for: %s (Value())", tc.description)
+		}
+	}
+}
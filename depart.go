@@ -0,0 +1,72 @@
+package gkv
+
+import (
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// depart marks the state of node p as departed, as it has left the mesh.
+// It is kept until purgeDeparted finds it past its grace period.
+func (cs *clusterState) depart(p mesh.PeerName, now time.Time) {
+	// get write lock
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	ns := cs.nodes[p]
+	if ns == nil || p == cs.self || !ns.departed.IsZero() {
+		return
+	}
+	cs.logger.Printf("Node %v departed", p)
+	ns.departed = now
+}
+
+// rejoin clears the departed mark of node p, and lets it back in if it
+// had been purged, as it is in the mesh again.
+// Must be called with the write lock held.
+func (cs *clusterState) rejoin(p mesh.PeerName) {
+	if ns := cs.nodes[p]; ns != nil && !ns.departed.IsZero() {
+		cs.logger.Printf("Node %v rejoined", p)
+		ns.departed = time.Time{}
+	}
+	if _, ok := cs.gone[p]; ok {
+		cs.logger.Printf("Purged node %v rejoined", p)
+		delete(cs.gone, p)
+	}
+}
+
+// purgeDeparted drops the state of every node that departed more than
+// grace ago, and tells the cluster to do the same.
+func (cs *clusterState) purgeDeparted(now time.Time, grace time.Duration) {
+	// get write lock
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	for p, ns := range cs.nodes {
+		if ns.departed.IsZero() || now.Sub(ns.departed) < grace {
+			continue
+		}
+		cs.purge(p, ns.incarnation)
+		cs.enqueue(delta{
+			Gone: true,
+			P:    p,
+			Ttl:  cs.ttl(ttlUpdate),
+			I:    ns.incarnation,
+		})
+	}
+}
+
+// purge drops the state of node p, and remembers its incarnation so that
+// deltas still in flight do not bring it back.
+// Must be called with the write lock held.
+func (cs *clusterState) purge(p mesh.PeerName, incarnation int64) {
+	cs.logger.Printf("Purged node %v", p)
+	if ns := cs.nodes[p]; ns != nil {
+		cs.keepCounters(ns)
+	}
+	delete(cs.nodes, p)
+	if cs.gone == nil {
+		cs.gone = map[mesh.PeerName]int64{}
+	}
+	cs.gone[p] = incarnation
+	// tombstones may have been waiting on p alone
+	cs.collectTombstones()
+}
@@ -0,0 +1,81 @@
+package gkv
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/weaveworks/mesh"
+)
+
+func TestStatePurgeDeparted(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	cs := clusterState{
+		self:   1,
+		logger: logger,
+		mtx:    &sync.RWMutex{},
+		nodes: map[mesh.PeerName]*nodeState{
+			1: newNodeState(1, 1),
+			123: &nodeState{
+				self:        123,
+				incarnation: 5,
+				set:         map[string]*valueInstance{"k1": &valueInstance{C: 2, D: true}},
+				clock:       2,
+			},
+			124: &nodeState{
+				self:        124,
+				incarnation: 7,
+				set:         map[string]*valueInstance{"k2": &valueInstance{C: 4, V: "v4"}},
+				clock:       4,
+				missed:      [][2]int{{1, 1}},
+			},
+		}}
+	t0 := time.Now()
+
+	cs.depart(124, t0)
+	cs.purgeDeparted(t0.Add(30*time.Second), time.Minute)
+	if cs.nodes[124] == nil || len(cs.Deltas) != 0 {
+		t.Errorf("Check purgeDeparted() failed: node purged within its grace period")
+	}
+
+	cs.purgeDeparted(t0.Add(2*time.Minute), time.Minute)
+	want := []delta{delta{Gone: true, P: 124, Ttl: 3, I: 7}}
+	if cs.nodes[124] != nil || !reflect.DeepEqual(cs.Deltas, want) {
+		t.Errorf("Check purgeDeparted() failed:\nWanted: %s\nGot: %s", spew.Sdump(want), spew.Sdump(cs.Deltas))
+	}
+	if cs.nodes[123].set["k1"] != nil {
+		t.Errorf("Check purgeDeparted() failed: tombstone waiting on departed node not collected")
+	}
+
+	// deltas still in flight don't bring it back
+	cs.Deltas = nil
+	cs.merge(&clusterState{Deltas: []delta{
+		delta{P: 124, Ttl: 2, K: "k3", Vi: valueInstance{C: 5, V: "v5"}, I: 7},
+	}})
+	if cs.nodes[124] != nil || len(cs.Deltas) != 0 {
+		t.Errorf("Check merge() failed: purged node brought back by %s", spew.Sdump(cs.Deltas))
+	}
+
+	// until it is in the mesh again
+	cs.setPeers(map[mesh.PeerName]bool{124: true}, map[mesh.PeerName]bool{124: true})
+	cs.merge(&clusterState{Deltas: []delta{
+		delta{P: 124, Ttl: 2, K: "k3", Vi: valueInstance{C: 5, V: "v5"}, I: 7},
+	}})
+	if cs.nodes[124] == nil || cs.nodes[124].set["k3"] == nil {
+		t.Errorf("Check merge() failed: rejoined node not accepted")
+	}
+
+	// and others purge it when told to
+	cs.Deltas = nil
+	cs.merge(&clusterState{Deltas: []delta{
+		delta{Gone: true, P: 123, Ttl: 2, I: 5},
+	}})
+	want = []delta{delta{Gone: true, P: 123, Ttl: 1, I: 5}}
+	if cs.nodes[123] != nil || !reflect.DeepEqual(cs.Deltas, want) {
+		t.Errorf("Check merge() failed:\nWanted: %s\nGot: %s", spew.Sdump(want), spew.Sdump(cs.Deltas))
+	}
+}
@@ -0,0 +1,81 @@
+package gkv
+
+import (
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+// setPeers records the other peers in the mesh, and which of them we
+// have a route to. Those we do are members, even if they had departed.
+func (cs *clusterState) setPeers(members, reachable map[mesh.PeerName]bool) {
+	// get write lock
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	left := false
+	for p := range cs.members {
+		if !members[p] {
+			left = true
+		}
+	}
+	cs.members = members
+	cs.size = len(members) + 1
+	cs.reachable = reachable
+	for p := range reachable {
+		cs.rejoin(p)
+	}
+	if left {
+		// tombstones may have been waiting on those that left
+		cs.collectTombstones()
+	}
+}
+
+// sendTo queues d to be unicast to dst, if dst is reachable, and to be
+// broadcast otherwise. Must be called with the write lock held.
+func (cs *clusterState) sendTo(dst mesh.PeerName, d delta) {
+	if dst == cs.self || !cs.reachable[dst] {
+		cs.enqueue(d)
+		return
+	}
+	if cs.direct == nil {
+		cs.direct = map[mesh.PeerName][]delta{}
+	}
+	cs.direct[dst] = append(cs.direct[dst], d)
+}
+
+// takeDirect returns the deltas queued for each peer and clears them.
+func (cs *clusterState) takeDirect() map[mesh.PeerName][]delta {
+	// get write lock
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	out := cs.direct
+	cs.direct = nil
+	return out
+}
+
+// singleHop returns a batch holding deltas with a hop count of one, as
+// they are sent straight to the one peer that needs them.
+func (cs *clusterState) singleHop(deltas []delta) *clusterState {
+	b := &clusterState{
+		Deltas:   make([]delta, len(deltas)),
+		logger:   cs.logger,
+		mtx:      &sync.RWMutex{},
+		codec:    cs.codec,
+		maxFrame: cs.maxFrame,
+	}
+	for i, d := range deltas {
+		d.Ttl = 1
+		b.Deltas[i] = d
+	}
+	return b
+}
+
+// requeue broadcasts deltas that could not be unicast.
+func (cs *clusterState) requeue(deltas []delta) {
+	// get write lock
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	for _, d := range deltas {
+		cs.enqueue(d)
+	}
+}
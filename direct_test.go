@@ -0,0 +1,96 @@
+package gkv
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/weaveworks/mesh"
+)
+
+func TestStateMergeDirect(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+
+	for _, tc := range []struct {
+		description string
+		reachable   map[mesh.PeerName]bool
+		src         mesh.PeerName
+		in          []delta
+		direct      map[mesh.PeerName][]delta
+		deltas      []delta
+	}{
+		{
+			"answer reachable requester directly",
+			map[mesh.PeerName]bool{124: true},
+			mesh.UnknownPeerName,
+			[]delta{
+				delta{Fix: true, P: 123, S: 124, Ttl: 3, Vi: valueInstance{C: 2}, To: 3},
+			},
+			map[mesh.PeerName][]delta{124: []delta{
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 3, V: "v3"}},
+				delta{Sup: true, P: 123, Ttl: 3, Vi: valueInstance{C: 2}},
+			}},
+			nil,
+		},
+		{
+			"unreachable requester, broadcast answer",
+			nil,
+			mesh.UnknownPeerName,
+			[]delta{
+				delta{Fix: true, P: 123, S: 124, Ttl: 3, Vi: valueInstance{C: 3}},
+			},
+			nil,
+			[]delta{
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 3, V: "v3"}},
+			},
+		},
+		{
+			"requester taken from sender",
+			map[mesh.PeerName]bool{125: true},
+			125,
+			[]delta{
+				delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 3}},
+			},
+			map[mesh.PeerName][]delta{125: []delta{
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 3, V: "v3"}},
+			}},
+			nil,
+		},
+		{
+			"gap requested from origin",
+			map[mesh.PeerName]bool{123: true},
+			123,
+			[]delta{
+				delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 6, V: "v6"}},
+			},
+			map[mesh.PeerName][]delta{123: []delta{
+				delta{Fix: true, P: 123, S: 1, Ttl: 3, Vi: valueInstance{C: 4}, To: 5},
+			}},
+			[]delta{
+				delta{P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 6, V: "v6"}},
+			},
+		},
+	} {
+		cs := clusterState{
+			self:      1,
+			logger:    logger,
+			mtx:       &sync.RWMutex{},
+			reachable: tc.reachable,
+			nodes: map[mesh.PeerName]*nodeState{
+				123: &nodeState{
+					self:  123,
+					set:   map[string]*valueInstance{"k1": &valueInstance{C: 3, V: "v3"}},
+					clock: 3,
+				}}}
+		cs.merge(&clusterState{Deltas: tc.in, src: tc.src})
+		if !reflect.DeepEqual(cs.direct, tc.direct) || !reflect.DeepEqual(cs.Deltas, tc.deltas) {
+			t.Errorf("Failed test for: %s (merge())", tc.description)
+			t.Errorf("Check merge() failed:\nWanted: %s %s\nGot: %s %s", spew.Sdump(tc.direct), spew.Sdump(tc.deltas), spew.Sdump(cs.direct), spew.Sdump(cs.Deltas))
+		} else {
+			t.Logf("Passed test for: %s (merge())", tc.description)
+		}
+	}
+}
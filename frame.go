@@ -0,0 +1,86 @@
+package gkv
+
+import (
+	"sort"
+
+	"github.com/weaveworks/mesh"
+)
+
+// DefaultMaxFrameSize is the largest encoded frame sent when
+// Config.MaxFrameSize is zero.
+const DefaultMaxFrameSize = 256 * 1024
+
+// frames encodes out as one or more frames of at most limit bytes,
+// splitting it in half until each part fits. A single delta or value
+// that is too big on its own is still sent, in a frame of its own.
+func (cs *clusterState) frames(codec Codec, out *clusterState, limit int) [][]byte {
+	b, err := codec.encode(out)
+	if err != nil {
+		cs.logger.Printf("Error encoding clusterState deltas: %v", err)
+		return [][]byte{b}
+	}
+	if len(b) <= limit {
+		return [][]byte{b}
+	}
+	first, second := out.split()
+	if second == nil {
+		cs.logger.Printf("Encoding oversized frame of %v bytes", len(b))
+		return [][]byte{b}
+	}
+	return append(cs.frames(codec, first, limit), cs.frames(codec, second, limit)...)
+}
+
+// split divides the deltas and states of cs in two, returning a nil second
+// half if cs can't be divided. A node state with many keys is split by key
+// into parts, each recording the range of keys it holds, so a receiver
+// only resolves the clocks of the values a part actually carries.
+func (cs *clusterState) split() (*clusterState, *clusterState) {
+	switch {
+	case len(cs.Deltas) > 0 && len(cs.States) > 0:
+		return &clusterState{Deltas: cs.Deltas}, &clusterState{States: cs.States}
+	case len(cs.Deltas) > 1:
+		h := len(cs.Deltas) / 2
+		return &clusterState{Deltas: cs.Deltas[:h]}, &clusterState{Deltas: cs.Deltas[h:]}
+	case len(cs.States) > 1:
+		peers := make([]mesh.PeerName, 0, len(cs.States))
+		for p := range cs.States {
+			peers = append(peers, p)
+		}
+		sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+		first := &clusterState{States: map[mesh.PeerName]*nodeSnapshot{}}
+		second := &clusterState{States: map[mesh.PeerName]*nodeSnapshot{}}
+		for i, p := range peers {
+			if i < len(peers)/2 {
+				first.States[p] = cs.States[p]
+			} else {
+				second.States[p] = cs.States[p]
+			}
+		}
+		return first, second
+	case len(cs.States) == 1:
+		for p, s := range cs.States {
+			if len(s.Set) < 2 {
+				break
+			}
+			keys := make([]string, 0, len(s.Set))
+			for k := range s.Set {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			a, b := *s, *s
+			a.To, b.From = keys[len(keys)/2], keys[len(keys)/2]
+			a.Set = make(map[string]valueInstance, len(keys)/2)
+			b.Set = make(map[string]valueInstance, len(keys)-len(keys)/2)
+			for i, k := range keys {
+				if i < len(keys)/2 {
+					a.Set[k] = s.Set[k]
+				} else {
+					b.Set[k] = s.Set[k]
+				}
+			}
+			return &clusterState{States: map[mesh.PeerName]*nodeSnapshot{p: &a}},
+				&clusterState{States: map[mesh.PeerName]*nodeSnapshot{p: &b}}
+		}
+	}
+	return cs, nil
+}
@@ -0,0 +1,149 @@
+package gkv
+
+import (
+	"sort"
+)
+
+// The clocks of a node we have missed are kept as sorted, disjoint runs
+// of [first, last] clocks. Every delta below the first run has been
+// received, and clocks are dropped from the runs as soon as they are
+// repaired or given up on, so the bookkeeping only grows with the number
+// of gaps that are actually open, however many clocks they span.
+
+// run returns the index of the first run of ns ending at or after c.
+func (ns *nodeState) run(c int) int {
+	return sort.Search(len(ns.missed), func(i int) bool { return ns.missed[i][1] >= c })
+}
+
+// low returns the clock up to which every delta of ns has been received.
+func (ns *nodeState) low() int {
+	if len(ns.missed) > 0 {
+		return ns.missed[0][0] - 1
+	}
+	return ns.clock
+}
+
+// missing reports whether clock c of ns has not been received.
+func (ns *nodeState) missing(c int) bool {
+	return within(ns.missed, c)
+}
+
+// miss records clocks from to to of ns as not received.
+func (ns *nodeState) miss(from, to int) {
+	if low := ns.low(); from <= low {
+		from = low + 1
+	}
+	if from > to {
+		return
+	}
+	// join any runs it overlaps or adjoins
+	i := ns.run(from - 1)
+	j := i
+	for ; j < len(ns.missed) && ns.missed[j][0] <= to+1; j++ {
+		if ns.missed[j][0] < from {
+			from = ns.missed[j][0]
+		}
+		if ns.missed[j][1] > to {
+			to = ns.missed[j][1]
+		}
+	}
+	runs := make([][2]int, 0, len(ns.missed)-(j-i)+1)
+	runs = append(runs, ns.missed[:i]...)
+	runs = append(runs, [2]int{from, to})
+	ns.missed = append(runs, ns.missed[j:]...)
+}
+
+// recover records clock c of ns as no longer outstanding, whether it was
+// received or given up on. It reports whether c had been missing.
+func (ns *nodeState) recover(c int) bool {
+	return ns.recoverRange(c, c) > 0
+}
+
+// recoverRange records clocks from to to of ns as no longer outstanding,
+// returning how many of them had been missing.
+func (ns *nodeState) recoverRange(from, to int) int {
+	i := ns.run(from)
+	j := sort.Search(len(ns.missed), func(j int) bool { return ns.missed[j][0] > to })
+	if i >= j {
+		return 0
+	}
+	// keep what lies either side of from to to
+	n := 0
+	runs := make([][2]int, 0, len(ns.missed)-(j-i)+2)
+	runs = append(runs, ns.missed[:i]...)
+	if first := ns.missed[i]; first[0] < from {
+		runs = append(runs, [2]int{first[0], from - 1})
+	}
+	for _, r := range ns.missed[i:j] {
+		if r[0] < from {
+			r[0] = from
+		}
+		if r[1] > to {
+			r[1] = to
+		}
+		n += r[1] - r[0] + 1
+	}
+	if last := ns.missed[j-1]; last[1] > to {
+		runs = append(runs, [2]int{to + 1, last[1]})
+	}
+	ns.missed = append(runs, ns.missed[j:]...)
+	if len(ns.missed) == 0 {
+		ns.missed = nil
+	}
+	return n
+}
+
+// advance moves the clock of ns on to c.
+func (ns *nodeState) advance(c int) {
+	ns.clock = c
+}
+
+// gaps returns the runs of clocks of ns still missing, in order.
+func (ns *nodeState) gaps() [][2]int {
+	if len(ns.missed) == 0 {
+		return nil
+	}
+	return append([][2]int(nil), ns.missed...)
+}
+
+// runs returns the clocks in cs, which must be in order, as inclusive
+// [first, last] runs.
+func runs(cs []int) [][2]int {
+	var out [][2]int
+	for _, c := range cs {
+		if n := len(out); n > 0 && out[n-1][1] >= c-1 {
+			if c > out[n-1][1] {
+				out[n-1][1] = c
+			}
+			continue
+		}
+		out = append(out, [2]int{c, c})
+	}
+	return out
+}
+
+// within reports whether clock c falls in one of runs, which must be
+// in order.
+func within(runs [][2]int, c int) bool {
+	i := sort.Search(len(runs), func(i int) bool { return runs[i][1] >= c })
+	return i < len(runs) && runs[i][0] <= c
+}
+
+// uncovered returns the runs of clocks from from to to that are not in
+// skip, which must be in order.
+func uncovered(from, to int, skip [][2]int) [][2]int {
+	var out [][2]int
+	for _, r := range skip {
+		if r[1] < from || r[0] > to {
+			continue
+		}
+		if r[0] > from {
+			out = append(out, [2]int{from, r[0] - 1})
+		}
+		from = r[1] + 1
+	}
+	if from <= to {
+		out = append(out, [2]int{from, to})
+	}
+	return out
+}
@@ -0,0 +1,57 @@
+package gkv
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNodeStateGaps(t *testing.T) {
+	ns := newNodeState(123, 0)
+	for _, tc := range []struct {
+		description string
+		op          func()
+		low         int
+		gaps        [][2]int
+	}{
+		{"in order", func() { ns.advance(1); ns.advance(2) }, 2, nil},
+		{"gap", func() { ns.miss(3, 5); ns.advance(6) }, 2, [][2]int{{3, 5}}},
+		{"repair above low", func() { ns.recover(4) }, 2, [][2]int{{3, 3}, {5, 5}}},
+		{"repair at low", func() { ns.recover(3) }, 4, [][2]int{{5, 5}}},
+		{"second gap", func() { ns.miss(7, 7); ns.advance(8) }, 4, [][2]int{{5, 5}, {7, 7}}},
+		{"clock below low is never missed", func() { ns.miss(1, 2) }, 4, [][2]int{{5, 5}, {7, 7}}},
+		{"adjoining gaps are joined", func() { ns.miss(9, 10); ns.miss(11, 12); ns.advance(12) }, 4, [][2]int{{5, 5}, {7, 7}, {9, 12}}},
+		{"overlapping gaps are joined", func() { ns.miss(6, 9) }, 4, [][2]int{{5, 12}}},
+		{"range repaired", func() { ns.recoverRange(6, 10) }, 4, [][2]int{{5, 5}, {11, 12}}},
+		{"repaired twice", func() { ns.recover(5); ns.recover(5) }, 10, [][2]int{{11, 12}}},
+		{"all repaired", func() { ns.recoverRange(1, 20) }, 12, nil},
+	} {
+		tc.op()
+		if ns.low() != tc.low || !reflect.DeepEqual(ns.gaps(), tc.gaps) {
+			t.Errorf("Failed test for: %s (gaps)", tc.description)
+			t.Errorf("Check gaps failed:\nWanted: %v %v\nGot: %v %v", tc.low, tc.gaps, ns.low(), ns.gaps())
+		} else {
+			t.Logf("Passed test for: %s (gaps)", tc.description)
+		}
+	}
+}
+
+func TestNodeStateLargeGap(t *testing.T) {
+	ns := newNodeState(123, 0)
+	ns.advance(1)
+	start := time.Now()
+	ns.miss(2, 1999999)
+	ns.advance(2000000)
+	for c := 2; c < 1000; c++ {
+		ns.recover(c)
+	}
+	if n := ns.recoverRange(1000, 1999999); n != 1999000 {
+		t.Errorf("Check recoverRange() failed: recovered %v clocks", n)
+	}
+	if len(ns.missed) != 0 || ns.low() != 2000000 {
+		t.Errorf("Check gaps failed: %v, low %v", ns.gaps(), ns.low())
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Check gaps failed: closing a large gap took %v", d)
+	}
+}
@@ -0,0 +1,106 @@
+package gkv
+
+import (
+	"sort"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock reading: wall time in milliseconds
+// in the high 48 bits, and a logical counter in the low 16. Every write
+// is stamped with one. A node's clock never runs behind a timestamp it
+// has seen, so timestamps order writes across nodes consistently with
+// causality, as long as their wall clocks are within MaxClockOffset.
+type Timestamp int64
+
+const logicalBits = 16
+
+// timestampAt returns the earliest Timestamp of wall time t.
+func timestampAt(t time.Time) Timestamp {
+	return Timestamp(t.UnixNano()/int64(time.Millisecond)) << logicalBits
+}
+
+// Time returns the wall time part of t.
+func (t Timestamp) Time() time.Time {
+	ms := int64(t >> logicalBits)
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Logical returns the logical counter part of t, which orders timestamps
+// that fall within the same millisecond.
+func (t Timestamp) Logical() int {
+	return int(t & (1<<logicalBits - 1))
+}
+
+// DefaultMaxClockOffset is how far ahead of our wall clock a peer's
+// Timestamps may move our clock when Config.MaxClockOffset is zero.
+const DefaultMaxClockOffset = 500 * time.Millisecond
+
+// hlClock issues Timestamps. It is guarded by the clusterState lock.
+type hlClock struct {
+	last Timestamp
+	// maxOffset bounds how far past the wall clock update moves last;
+	// zero leaves it unbounded.
+	maxOffset time.Duration
+}
+
+// now returns a Timestamp later than any issued or seen so far, and no
+// earlier than wall. Must be called with the write lock held.
+func (c *hlClock) now(wall time.Time) Timestamp {
+	t := timestampAt(wall)
+	if t <= c.last {
+		t = c.last + 1
+	}
+	c.last = t
+	return t
+}
+
+// update moves the clock past t, a Timestamp seen from another node,
+// but no further than maxOffset ahead of wall. It reports whether t was
+// beyond that bound, so a peer whose clock runs fast can't drag ours
+// along with it. Must be called with the write lock held.
+func (c *hlClock) update(t Timestamp, wall time.Time) bool {
+	ok := true
+	if c.maxOffset > 0 {
+		if max := timestampAt(wall.Add(c.maxOffset)); t > max {
+			t, ok = max, false
+		}
+	}
+	if t > c.last {
+		c.last = t
+	}
+	return ok
+}
+
+// Now returns a Timestamp later than every write we have made or seen.
+func (cs *clusterState) Now() Timestamp {
+	// get write lock
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	return cs.hlc.now(time.Now())
+}
+
+// ModifiedSince returns every version of every key, on any node, written
+// after since, in the order they were written. Deletions are included.
+// Writes are only seen once they have been gossiped to us, so a write
+// stamped before since may yet arrive from a node we have not heard from.
+func (cs *clusterState) ModifiedSince(since Timestamp) []Version {
+	// get read lock
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+	now := cs.now()
+	var out []Version
+	for p, ns := range cs.nodes {
+		for k, vi := range ns.set {
+			if vi.T > since && !vi.expired(now) && !internal(k) {
+				out = append(out, vi.version(k, p))
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Stamp != out[j].Stamp {
+			return out[i].Stamp < out[j].Stamp
+		}
+		return out[i].Peer < out[j].Peer
+	})
+	return out
+}
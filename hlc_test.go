@@ -0,0 +1,93 @@
+package gkv
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestHLClock(t *testing.T) {
+	t0 := time.Unix(1500000000, 0)
+	c := hlClock{maxOffset: time.Minute}
+	for _, tc := range []struct {
+		description string
+		wall        time.Time
+		seen        Timestamp
+		within      bool
+		want        Timestamp
+	}{
+		{"wall time", t0, 0, true, timestampAt(t0)},
+		{"same millisecond", t0, 0, true, timestampAt(t0) + 1},
+		{"wall clock went back", t0.Add(-time.Second), 0, true, timestampAt(t0) + 2},
+		{"wall clock caught up", t0.Add(time.Second), 0, true, timestampAt(t0.Add(time.Second))},
+		{"remote clock ahead", t0.Add(time.Second), timestampAt(t0.Add(time.Minute)) + 5, true, timestampAt(t0.Add(time.Minute)) + 6},
+		{"remote clock beyond max offset", t0.Add(2 * time.Second), timestampAt(t0.Add(time.Hour)), false, timestampAt(t0.Add(2*time.Second+time.Minute)) + 1},
+	} {
+		within := c.update(tc.seen, tc.wall)
+		if got := c.now(tc.wall); got != tc.want || within != tc.within {
+			t.Errorf("Failed test for: %s (now())", tc.description)
+			t.Errorf("Check now() failed:\nWanted: %v %v\nGot: %v %v", tc.want, tc.within, got, within)
+		} else {
+			t.Logf("Passed test for: %s (now())", tc.description)
+		}
+	}
+	if ts := timestampAt(t0) + 3; !ts.Time().Equal(t0) || ts.Logical() != 3 {
+		t.Errorf("Check Timestamp failed: %v %v", ts.Time(), ts.Logical())
+	}
+}
+
+func TestStateModifiedSince(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	cs := newClusterState(1, logger)
+	cs.Set("k1", "v1")
+	since := cs.Now()
+	cs.Set("k2", "v2")
+	// a write from a node whose clock runs ahead
+	ahead := timestampAt(time.Now().Add(100 * time.Millisecond))
+	cs.Merge(&clusterState{Deltas: []delta{
+		delta{P: 123, Ttl: 1, K: "k3", Vi: valueInstance{C: 1, V: "v3", T: ahead}},
+	}})
+	cs.Set("k4", "v4")
+	cs.Delete("k2")
+
+	var got []string
+	for _, v := range cs.ModifiedSince(since) {
+		got = append(got, v.Key)
+	}
+	want := []string{"k3", "k4", "k2"}
+	if len(got) != len(want) {
+		t.Fatalf("Check ModifiedSince() failed:\nWanted: %v\nGot: %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Check ModifiedSince() failed:\nWanted: %v\nGot: %v", want, got)
+			break
+		}
+	}
+	// our later writes are ordered after the one we saw
+	if cs.nodes[1].set["k4"].T <= ahead {
+		t.Errorf("Check hybrid clock failed: %v not after %v", cs.nodes[1].set["k4"].T, ahead)
+	}
+}
+
+func TestStateClockDrift(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	cs := newClusterState(1, logger)
+	// a write from a node whose clock runs two hours fast
+	ahead := timestampAt(time.Now().Add(2 * time.Hour))
+	cs.Merge(&clusterState{Deltas: []delta{
+		delta{P: 123, Ttl: 1, K: "k1", Vi: valueInstance{C: 1, V: "v1", T: ahead}},
+	}})
+	cs.SetWithExpiry("k2", "v2", time.Hour)
+	if v, err := cs.Get(1, "k2"); err != nil || v != "v2" {
+		t.Errorf("Check Get() failed: %q, %v", v, err)
+	}
+	cs.expire(time.Now())
+	if _, err := cs.Get(1, "k2"); err != nil {
+		t.Errorf("Check expire() failed: %v", err)
+	}
+	if now := cs.Now(); now >= timestampAt(time.Now().Add(time.Hour)) {
+		t.Errorf("Check hybrid clock failed: %v dragged ahead to %v", now.Time(), ahead.Time())
+	}
+}
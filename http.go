@@ -0,0 +1,192 @@
+package gkv
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// NewHandler returns an http.Handler exposing n as a JSON API:
+//
+//	GET    /v1/kv                      keys owned by n
+//	GET    /v1/kv/{key}                value of key owned by n
+//	PUT    /v1/kv/{key}                set key, body {"value": "...", "ttl": "30s"}
+//	DELETE /v1/kv/{key}                delete key
+//	GET    /v1/nodes                   peers n holds state for
+//	GET    /v1/nodes/{peer}/kv         keys owned by peer
+//	GET    /v1/nodes/{peer}/kv/{key}   value of key owned by peer
+func NewHandler(n *Node) http.Handler {
+	return &handler{n: n}
+}
+
+type handler struct {
+	n *Node
+}
+
+type kvResponse struct {
+	Peer  string `json:"peer"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type kvRequest struct {
+	Value string `json:"value"`
+	TTL   string `json:"ttl,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if path == r.URL.Path {
+		h.error(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch {
+	case path == "kv":
+		h.list(w, r, h.n.Name())
+	case strings.HasPrefix(path, "kv/"):
+		h.kv(w, r, strings.TrimPrefix(path, "kv/"))
+	case path == "nodes":
+		h.nodes(w, r)
+	case strings.HasPrefix(path, "nodes/"):
+		// {peer}/kv[/{key}]
+		parts := strings.SplitN(strings.TrimPrefix(path, "nodes/"), "/", 3)
+		if len(parts) < 2 || parts[1] != "kv" {
+			h.error(w, http.StatusNotFound, "not found")
+			return
+		}
+		peer, err := mesh.PeerNameFromString(parts[0])
+		if err != nil {
+			h.error(w, http.StatusBadRequest, "invalid peer name: "+err.Error())
+			return
+		}
+		if len(parts) == 2 {
+			h.list(w, r, peer)
+		} else {
+			h.get(w, r, peer, parts[2])
+		}
+	default:
+		h.error(w, http.StatusNotFound, "not found")
+	}
+}
+
+// kv serves reads and writes of keys owned by this node.
+func (h *handler) kv(w http.ResponseWriter, r *http.Request, key string) {
+	if key == "" {
+		h.error(w, http.StatusNotFound, "not found")
+		return
+	}
+	if internal(key) {
+		h.error(w, http.StatusBadRequest, ErrReservedKey.Error())
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.get(w, r, h.n.Name(), key)
+	case http.MethodPut:
+		var req kvRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.error(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+				h.error(w, http.StatusBadRequest, "invalid ttl: "+req.TTL)
+				return
+			}
+		}
+		h.n.SetWithExpiry(key, req.Value, ttl)
+		h.json(w, http.StatusOK, kvResponse{h.n.Name().String(), key, req.Value})
+	case http.MethodDelete:
+		if err := h.n.Delete(key); err != nil {
+			h.lookupError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		h.error(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// get serves the value of key owned by peer.
+func (h *handler) get(w http.ResponseWriter, r *http.Request, peer mesh.PeerName, key string) {
+	if internal(key) {
+		h.error(w, http.StatusBadRequest, ErrReservedKey.Error())
+		return
+	}
+	if r.Method != http.MethodGet {
+		h.error(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	v, err := h.n.Get(peer, key)
+	if err != nil {
+		h.lookupError(w, err)
+		return
+	}
+	h.json(w, http.StatusOK, kvResponse{peer.String(), key, v})
+}
+
+// list serves every live key owned by peer.
+func (h *handler) list(w http.ResponseWriter, r *http.Request, peer mesh.PeerName) {
+	if r.Method != http.MethodGet {
+		h.error(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	kvs, err := h.n.Keys(peer)
+	if err != nil {
+		h.lookupError(w, err)
+		return
+	}
+	out := make([]kvResponse, 0, len(kvs))
+	for k, v := range kvs {
+		out = append(out, kvResponse{peer.String(), k, v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	h.json(w, http.StatusOK, out)
+}
+
+// nodes serves the peers we hold state for.
+func (h *handler) nodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.error(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	nodes := h.n.Nodes()
+	out := make([]string, 0, len(nodes))
+	for _, p := range nodes {
+		out = append(out, p.String())
+	}
+	sort.Strings(out)
+	h.json(w, http.StatusOK, out)
+}
+
+// lookupError maps state lookup errors onto HTTP statuses.
+func (h *handler) lookupError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNodeNotFound, ErrKeyNotFound:
+		h.error(w, http.StatusNotFound, err.Error())
+	default:
+		h.error(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (h *handler) error(w http.ResponseWriter, status int, msg string) {
+	h.json(w, status, errorResponse{msg})
+}
+
+func (h *handler) json(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.n.logger.Printf("Error encoding HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package gkv
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	n := &Node{name: 1, peer: newPeer(1, logger), logger: logger}
+	h := NewHandler(n)
+
+	for _, tc := range []struct {
+		description string
+		method      string
+		path        string
+		body        string
+		status      int
+		expected    string
+	}{
+		{"get missing key", "GET", "/v1/kv/k1", "", http.StatusNotFound, `{"error":"key not found"}`},
+		{"put key", "PUT", "/v1/kv/k1", `{"value":"v1"}`, http.StatusOK, `{"peer":"00:00:00:00:00:01","key":"k1","value":"v1"}`},
+		{"put key with ttl", "PUT", "/v1/kv/a/k2", `{"value":"v2","ttl":"1h"}`, http.StatusOK, `{"peer":"00:00:00:00:00:01","key":"a/k2","value":"v2"}`},
+		{"put bad ttl", "PUT", "/v1/kv/k3", `{"value":"v3","ttl":"soon"}`, http.StatusBadRequest, `{"error":"invalid ttl: soon"}`},
+		{"get key", "GET", "/v1/kv/k1", "", http.StatusOK, `{"peer":"00:00:00:00:00:01","key":"k1","value":"v1"}`},
+		{"list keys", "GET", "/v1/kv", "", http.StatusOK, `[{"peer":"00:00:00:00:00:01","key":"a/k2","value":"v2"},{"peer":"00:00:00:00:00:01","key":"k1","value":"v1"}]`},
+		{"get peer key", "GET", "/v1/nodes/00:00:00:00:00:01/kv/k1", "", http.StatusOK, `{"peer":"00:00:00:00:00:01","key":"k1","value":"v1"}`},
+		{"get unknown peer key", "GET", "/v1/nodes/00:00:00:00:00:02/kv/k1", "", http.StatusNotFound, `{"error":"node not found"}`},
+		{"get invalid peer", "GET", "/v1/nodes/nope/kv/k1", "", http.StatusBadRequest, ""},
+		{"list nodes", "GET", "/v1/nodes", "", http.StatusOK, `["00:00:00:00:00:01"]`},
+		{"delete key", "DELETE", "/v1/kv/k1", "", http.StatusNoContent, ""},
+		{"delete missing key", "DELETE", "/v1/kv/k1", "", http.StatusNotFound, `{"error":"key not found"}`},
+		{"post key", "POST", "/v1/kv/k1", "", http.StatusMethodNotAllowed, `{"error":"method not allowed"}`},
+		{"put reserved key", "PUT", "/v1/kv/%00counter/c", `{"value":"9,0"}`, http.StatusBadRequest, `{"error":"key is reserved"}`},
+		{"delete reserved key", "DELETE", "/v1/kv/%00counter/c", "", http.StatusBadRequest, `{"error":"key is reserved"}`},
+		{"get reserved key", "GET", "/v1/kv/%00counter/c", "", http.StatusBadRequest, `{"error":"key is reserved"}`},
+		{"get peer reserved key", "GET", "/v1/nodes/00:00:00:00:00:01/kv/%00counter/c", "", http.StatusBadRequest, `{"error":"key is reserved"}`},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		out := strings.TrimSpace(w.Body.String())
+		if w.Code != tc.status || (tc.expected != "" && out != tc.expected) {
+			t.Errorf("Failed test for: %s (ServeHTTP() response)", tc.description)
+			t.Errorf("Check ServeHTTP() failed:\nWanted: %d %s\nGot: %d %s", tc.status, tc.expected, w.Code, out)
+		} else {
+			t.Logf("Passed test for: %s (ServeHTTP() response)", tc.description)
+		}
+	}
+}
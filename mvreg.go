@@ -0,0 +1,142 @@
+package gkv
+
+import (
+	"sort"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Every write records which writes of its key by other nodes it had
+// observed, so the values nodes hold for a key can be read as a
+// multi-value register: those no other value supersedes were written
+// concurrently, and are all returned by GetValues. The next write of
+// the key, by any node, observes and so resolves them.
+
+// writer identifies a node's incarnation.
+type writer struct {
+	p mesh.PeerName
+	i int64
+}
+
+// observed returns the writes of key by other nodes, and everything
+// those had observed in turn, as the context of a new write. Writes by
+// lives of nodes that have since ended are left out, as they can no
+// longer be held anywhere.
+// Must be called with the read lock held.
+func (cs *clusterState) observed(key string) []writeTag {
+	if internal(key) {
+		// only ever written by their owner
+		return nil
+	}
+	latest := map[writer]int{}
+	see := func(t writeTag) {
+		if ns := cs.nodes[t.P]; ns == nil || ns.incarnation != t.I {
+			return
+		}
+		w := writer{t.P, t.I}
+		if c, ok := latest[w]; !ok || t.C > c {
+			latest[w] = t.C
+		}
+	}
+	for p, ns := range cs.nodes {
+		vi := ns.set[key]
+		if vi == nil || p == cs.self {
+			continue
+		}
+		see(writeTag{P: p, I: ns.incarnation, C: vi.C})
+		for _, t := range vi.O {
+			see(t)
+		}
+	}
+	var out []writeTag
+	for w, c := range latest {
+		if w.p != cs.self {
+			out = append(out, writeTag{P: w.p, I: w.i, C: c})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].P != out[j].P {
+			return out[i].P < out[j].P
+		}
+		return out[i].I < out[j].I
+	})
+	return out
+}
+
+// frontier returns the versions of key, live or deleted, that no other
+// version supersedes, ordered by peer.
+// Must be called with the read lock held.
+func (cs *clusterState) frontier(key string) []Version {
+	versions := cs.versions(key)
+	// the latest clock of each writer that some version has observed
+	latest := map[writer]int{}
+	for _, v := range versions {
+		for _, t := range cs.nodes[v.Peer].set[key].O {
+			w := writer{t.P, t.I}
+			if c, ok := latest[w]; !ok || t.C > c {
+				latest[w] = t.C
+			}
+		}
+	}
+	out := versions[:0]
+	for _, v := range versions {
+		if c, ok := latest[writer{v.Peer, cs.nodes[v.Peer].incarnation}]; ok && c >= v.Clock {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// GetValues returns every live value of key written concurrently, with
+// the node and clock each was written at. There is more than one only
+// while writes on different nodes have not seen each other. A deletion
+// that has seen every value leaves the key not found.
+func (cs *clusterState) GetValues(key string) ([]Version, error) {
+	if internal(key) {
+		return nil, ErrKeyNotFound
+	}
+	// get read lock
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+	var out []Version
+	for _, v := range cs.frontier(key) {
+		if !v.Deleted {
+			out = append(out, v)
+		}
+	}
+	if len(out) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return out, nil
+}
+
+// hides reports whether the tombstone vi of key supersedes a live value
+// another node still holds, which would be seen again were it collected.
+// Must be called with the read lock held.
+func (cs *clusterState) hides(key string, vi *valueInstance) bool {
+	for _, t := range vi.O {
+		ns := cs.nodes[t.P]
+		if ns == nil || ns.incarnation != t.I {
+			continue
+		}
+		if cur := ns.set[key]; cur != nil && !cur.D && cur.C <= t.C {
+			return true
+		}
+	}
+	return false
+}
+
+// collectHiding collects the tombstones of key that were kept to hide
+// old, the value ns held before it was replaced.
+// Must be called with the write lock held.
+func (cs *clusterState) collectHiding(ns *nodeState, key string, old *valueInstance) {
+	if old == nil || old.D {
+		return
+	}
+	for _, other := range cs.nodes {
+		if other != ns {
+			cs.collectTombstone(other, key)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package gkv
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestStateGetValues(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	a := newClusterState(1, logger)
+	b := newClusterState(2, logger)
+	exchange := func() {
+		if d := a.takeDeltas(); d != nil {
+			b.Merge(d)
+		}
+		if d := b.takeDeltas(); d != nil {
+			a.Merge(d)
+		}
+	}
+	type value struct {
+		peer  mesh.PeerName
+		value string
+	}
+
+	for _, tc := range []struct {
+		description string
+		op          func()
+		want        []value
+	}{
+		{"single write", func() { a.Set("k", "v1") }, []value{{1, "v1"}}},
+		{"later write elsewhere supersedes", func() { b.Set("k", "v2") }, []value{{2, "v2"}}},
+		{"concurrent writes", func() { a.Set("k", "v3"); b.Set("k", "v4") }, []value{{1, "v3"}, {2, "v4"}}},
+		{"next write resolves", func() { a.Set("k", "v5") }, []value{{1, "v5"}}},
+		{"deletion resolves", func() { b.Set("k", "v6"); exchange(); a.Delete("k") }, nil},
+		{"write after deletion", func() { b.Set("k", "v7") }, []value{{2, "v7"}}},
+	} {
+		tc.op()
+		exchange()
+		for _, cs := range []*clusterState{a, b} {
+			got, err := cs.GetValues("k")
+			ok := len(got) == len(tc.want) && (err == nil) == (tc.want != nil)
+			for i := 0; ok && i < len(got); i++ {
+				ok = got[i].Peer == tc.want[i].peer && got[i].Value == tc.want[i].value &&
+					got[i].Clock == cs.nodes[got[i].Peer].set["k"].C
+			}
+			if !ok {
+				t.Errorf("Failed test for: %s (GetValues() on %v)", tc.description, cs.self)
+				t.Errorf("Check GetValues() failed:\nWanted: %v\nGot: %+v %v", tc.want, got, err)
+			} else {
+				t.Logf("Passed test for: %s (GetValues() on %v)", tc.description, cs.self)
+			}
+		}
+	}
+	// the tombstone is collected once it hides nothing
+	if vi := a.nodes[1].set["k"]; vi != nil {
+		t.Errorf("Check collectTombstone() failed: tombstone kept: %+v", vi)
+	}
+}
+
+func TestStateObserved(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	cs := newClusterState(3, logger)
+	cs.nodes[1] = newNodeState(1, 5)
+	cs.nodes[2] = newNodeState(2, 7)
+	cs.nodes[1].put("k", &valueInstance{C: 2, V: "v1"})
+	cs.nodes[2].put("k", &valueInstance{C: 4, V: "v2", O: []writeTag{
+		{P: 1, I: 3, C: 9}, // earlier life of node 1
+		{P: 1, I: 5, C: 1},
+		{P: 8, I: 1, C: 1}, // node since purged
+	}})
+	want := []writeTag{{P: 1, I: 5, C: 2}, {P: 2, I: 7, C: 4}}
+	if got := cs.observed("k"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Failed test for: ended lives left out (observed())")
+		t.Errorf("Check observed() failed:\nWanted: %v\nGot: %v", want, got)
+	} else {
+		t.Logf("Passed test for: ended lives left out (observed())")
+	}
+}
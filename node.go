@@ -0,0 +1,370 @@
+package gkv
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// DefaultChannel is the gossip channel used when Config.Channel is empty.
+const DefaultChannel = "gkv"
+
+// DefaultSnapshotInterval is how often state is snapshotted to disk when
+// Config.DataDir is set and Config.SnapshotInterval is zero.
+const DefaultSnapshotInterval = time.Minute
+
+// DefaultSweepInterval is how often expired values are dropped when
+// Config.SweepInterval is zero.
+const DefaultSweepInterval = time.Second
+
+// Config describes how a Node joins the mesh.
+type Config struct {
+	// Name uniquely identifies this node within the mesh.
+	Name mesh.PeerName
+	// NickName is a human readable name for this node.
+	NickName string
+	// Host and Port the mesh router listens on; Port defaults to mesh.Port.
+	Host string
+	Port int
+	// Password, if set, encrypts traffic between peers.
+	Password []byte
+	// ConnLimit caps the number of mesh connections; 0 means no limit.
+	ConnLimit int
+	// Channel is the gossip channel name, defaults to DefaultChannel.
+	Channel string
+	// Logger receives router and state logging; nil discards it.
+	Logger *log.Logger
+	// SweepInterval is how often expired values are dropped,
+	// defaults to DefaultSweepInterval.
+	SweepInterval time.Duration
+	// DataDir, if set, is where state is persisted so that a restarted
+	// node recovers its keys, clock and view of peers.
+	DataDir string
+	// SnapshotInterval is how often state in DataDir is snapshotted and
+	// its write-ahead log truncated, defaults to DefaultSnapshotInterval.
+	SnapshotInterval time.Duration
+	// Repair controls re-requesting missed deltas; zero fields take
+	// their value from DefaultRepairPolicy.
+	Repair RepairPolicy
+	// MaxQueue caps the deltas waiting to be gossiped; 0 means no limit.
+	// Repeated updates of a key are coalesced before the cap applies, and
+	// tombstone acks and repair requests are never dropped.
+	MaxQueue int
+	// DropPolicy decides what is discarded when MaxQueue is reached.
+	DropPolicy DropPolicy
+	// MaxFrameSize bounds each encoded gossip frame, in bytes; bigger
+	// bursts are split over several frames. Defaults to DefaultMaxFrameSize.
+	MaxFrameSize int
+	// DepartedGrace is how long the state of a peer that has left the
+	// mesh is kept, in case it returns; zero purges it at the next sweep.
+	DepartedGrace time.Duration
+	// TTL sets how far the deltas this node originates are forwarded.
+	TTL TTLPolicy
+	// MaxClockOffset bounds how far ahead of this node's wall clock a
+	// peer's write timestamps may move its hybrid clock, defaults to
+	// DefaultMaxClockOffset.
+	MaxClockOffset time.Duration
+	// Codec encodes gossip, JSONCodec or BinaryCodec, defaults to
+	// JSONCodec. Either can be decoded regardless, so a running cluster
+	// can switch one node at a time.
+	Codec Codec
+}
+
+// Node is a member of a gkv cluster.
+// It owns a mesh.Router and the peer gossiping over it.
+type Node struct {
+	name   mesh.PeerName
+	router *mesh.Router
+	peer   *peer
+	logger *log.Logger
+	sweep  time.Duration
+	snap   time.Duration
+	repair RepairPolicy
+	grace  time.Duration
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New constructs a Node from cfg, registering its gossiper with a new
+// mesh.Router. Call Start to begin listening.
+func New(cfg Config) (*Node, error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = mesh.Port
+	}
+	channel := cfg.Channel
+	if channel == "" {
+		channel = DefaultChannel
+	}
+	sweep := cfg.SweepInterval
+	if sweep == 0 {
+		sweep = DefaultSweepInterval
+	}
+	snap := cfg.SnapshotInterval
+	if snap == 0 {
+		snap = DefaultSnapshotInterval
+	}
+
+	router, err := mesh.NewRouter(mesh.Config{
+		Host:               cfg.Host,
+		Port:               port,
+		ProtocolMinVersion: mesh.ProtocolMinVersion,
+		Password:           cfg.Password,
+		ConnLimit:          cfg.ConnLimit,
+		PeerDiscovery:      true,
+		TrustedSubnets:     []*net.IPNet{},
+	}, cfg.Name, cfg.NickName, mesh.NullOverlay{}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newPeer(cfg.Name, logger)
+	p.cs.codec = cfg.Codec
+	p.cs.maxQueue = cfg.MaxQueue
+	p.cs.drop = cfg.DropPolicy
+	p.cs.maxFrame = cfg.MaxFrameSize
+	p.cs.ttls = cfg.TTL
+	if cfg.MaxClockOffset > 0 {
+		p.cs.hlc.maxOffset = cfg.MaxClockOffset
+	}
+	if cfg.DataDir != "" {
+		if err := p.cs.openStore(cfg.DataDir); err != nil {
+			return nil, err
+		}
+	}
+	gossip, err := router.NewGossip(channel, p)
+	if err != nil {
+		return nil, err
+	}
+	p.register(gossip)
+	router.Peers.OnGC(func(gone *mesh.Peer) {
+		p.cs.depart(gone.Name, time.Now())
+	})
+
+	return &Node{
+		name:   cfg.Name,
+		router: router,
+		peer:   p,
+		logger: logger,
+		sweep:  sweep,
+		snap:   snap,
+		repair: cfg.Repair.withDefaults(),
+		grace:  cfg.DepartedGrace,
+		quit:   make(chan struct{}),
+	}, nil
+}
+
+// Name returns the mesh.PeerName of this node.
+func (n *Node) Name() mesh.PeerName {
+	return n.name
+}
+
+// Start the mesh router, accepting and making connections.
+func (n *Node) Start() {
+	n.logger.Printf("Starting node %v", n.name)
+	n.router.Start()
+	n.every(n.sweep, func(now time.Time) {
+		n.refreshPeers()
+		n.peer.cs.expire(now)
+		n.peer.cs.purgeDeparted(now, n.grace)
+		n.peer.flush()
+	})
+	n.every(n.repair.Interval, func(now time.Time) {
+		n.peer.cs.retryRepairs(now, n.repair)
+		n.peer.flush()
+	})
+	n.every(n.snap, func(time.Time) {
+		if err := n.peer.cs.saveSnapshot(); err != nil {
+			n.logger.Printf("Error saving snapshot: %v", err)
+		}
+	})
+}
+
+// every runs fn at each interval until the node is stopped.
+func (n *Node) every(interval time.Duration, fn func(now time.Time)) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case now := <-t.C:
+				fn(now)
+			case <-n.quit:
+				return
+			}
+		}
+	}()
+}
+
+// refreshPeers tells our state how big the mesh is and which peers can
+// be reached directly.
+func (n *Node) refreshPeers() {
+	descs := n.router.Peers.Descriptions()
+	members := make(map[mesh.PeerName]bool, len(descs))
+	reachable := make(map[mesh.PeerName]bool, len(descs))
+	for _, d := range descs {
+		if d.Self {
+			continue
+		}
+		members[d.Name] = true
+		if _, ok := n.router.Routes.Unicast(d.Name); ok {
+			reachable[d.Name] = true
+		}
+	}
+	n.peer.cs.setPeers(members, reachable)
+}
+
+// Connect to the given peer addresses (host:port).
+// All addresses are attempted; the first error is returned.
+func (n *Node) Connect(peers ...string) error {
+	var first error
+	for _, err := range n.router.ConnectionMaker.InitiateConnections(peers, false) {
+		n.logger.Printf("Error connecting to peer: %v", err)
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Stop the mesh router, leaving the cluster.
+// Pending deltas are flushed first.
+func (n *Node) Stop() error {
+	n.logger.Printf("Stopping node %v", n.name)
+	n.peer.flush()
+	close(n.quit)
+	n.wg.Wait()
+	if err := n.peer.cs.closeStore(); err != nil {
+		n.logger.Printf("Error closing store: %v", err)
+	}
+	return n.router.Stop()
+}
+
+// Set key to value on this node and gossip the change. Keys starting
+// with a NUL byte are reserved, and are not written.
+func (n *Node) Set(key, value string) {
+	n.peer.cs.Set(key, value)
+	n.peer.flush()
+}
+
+// SetWithExpiry sets key to value on this node, expiring it after d,
+// and gossips the change.
+func (n *Node) SetWithExpiry(key, value string, d time.Duration) {
+	n.peer.cs.SetWithExpiry(key, value, d)
+	n.peer.flush()
+}
+
+// Get the value of key as owned by node.
+func (n *Node) Get(node mesh.PeerName, key string) (string, error) {
+	return n.peer.cs.Get(node, key)
+}
+
+// GetAny returns the value of key held by any node, this one's if it has
+// one.
+func (n *Node) GetAny(key string) (string, error) {
+	return n.peer.cs.GetAny(key)
+}
+
+// GetResolved returns the value of key as picked by r, LastWriterWins if
+// nil, from the versions held by every node.
+func (n *Node) GetResolved(key string, r Resolver) (string, error) {
+	return n.peer.cs.GetResolved(key, r)
+}
+
+// GetValues returns every value of key written concurrently across the
+// cluster, with the node and clock each was written at. Writing the key
+// again resolves them.
+func (n *Node) GetValues(key string) ([]Version, error) {
+	return n.peer.cs.GetValues(key)
+}
+
+// Now returns a hybrid logical clock Timestamp later than every write
+// this node has made or seen, for use with ModifiedSince.
+func (n *Node) Now() Timestamp {
+	return n.peer.cs.Now()
+}
+
+// ModifiedSince returns every version of every key written after since,
+// in the order they were written.
+func (n *Node) ModifiedSince(since Timestamp) []Version {
+	return n.peer.cs.ModifiedSince(since)
+}
+
+// Delete key on this node and gossip the tombstone.
+func (n *Node) Delete(key string) error {
+	if err := n.peer.cs.Delete(key); err != nil {
+		return err
+	}
+	n.peer.flush()
+	return nil
+}
+
+// Incr adds by to counter name, and gossips the change.
+func (n *Node) Incr(name string, by uint64) {
+	n.peer.cs.Incr(name, by)
+	n.peer.flush()
+}
+
+// Decr takes by from counter name, and gossips the change.
+func (n *Node) Decr(name string, by uint64) {
+	n.peer.cs.Decr(name, by)
+	n.peer.flush()
+}
+
+// Value returns the value of counter name, summed across every node.
+func (n *Node) Value(name string) int64 {
+	return n.peer.cs.Value(name)
+}
+
+// Add adds elem to set name, and gossips the change.
+func (n *Node) Add(name, elem string) {
+	n.peer.cs.Add(name, elem)
+	n.peer.flush()
+}
+
+// Remove removes elem from set name, and gossips the change.
+func (n *Node) Remove(name, elem string) error {
+	if err := n.peer.cs.Remove(name, elem); err != nil {
+		return err
+	}
+	n.peer.flush()
+	return nil
+}
+
+// Members returns the elements of set name.
+func (n *Node) Members(name string) []string {
+	return n.peer.cs.Members(name)
+}
+
+// Nodes returns the peers this node holds state for.
+func (n *Node) Nodes() []mesh.PeerName {
+	return n.peer.cs.Nodes()
+}
+
+// Keys returns the live keys and values owned by node.
+func (n *Node) Keys(node mesh.PeerName) (map[string]string, error) {
+	return n.peer.cs.Keys(node)
+}
+
+// RepairStats returns counters of missed deltas re-requested and abandoned.
+func (n *Node) RepairStats() RepairStats {
+	return n.peer.cs.RepairStats()
+}
+
+// Watch returns a channel of changes to keys starting with keyPrefix owned
+// by node, or by any node if node is mesh.UnknownPeerName.
+// The channel is closed once ctx is done.
+func (n *Node) Watch(ctx context.Context, node mesh.PeerName, keyPrefix string) <-chan Event {
+	return n.peer.cs.Watch(ctx, node, keyPrefix)
+}
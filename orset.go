@@ -0,0 +1,257 @@
+package gkv
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+)
+
+// setPrefix starts the key each node keeps its slot of a set in.
+const setPrefix = internalPrefix + "set/"
+
+// writeTag identifies one write: the node that made it, the incarnation
+// of that node, and its clock. Set elements are tagged by the write that
+// added them.
+type writeTag struct {
+	P mesh.PeerName
+	I int64 `json:",omitempty"`
+	C int
+}
+
+// setSlot is one node's share of an observed-remove set (OR-Set): the
+// elements it added, each tagged by the clocks it added them at, and the
+// tags added by other nodes that it has since removed. An element is a
+// member while any of its tags is not removed, so an add made concurrently
+// with a remove elsewhere survives it. As with counters, only the owning
+// node writes its slot, so the newest write of it is always right.
+type setSlot struct {
+	A map[string][]int `json:",omitempty"`
+	R []writeTag       `json:",omitempty"`
+}
+
+// setSlot returns the slot of set name held by node p.
+// Must be called with the read lock held.
+func (cs *clusterState) setSlot(p mesh.PeerName, name string) setSlot {
+	var s setSlot
+	vi := cs.nodes[p].set[setPrefix+name]
+	if vi == nil || vi.D {
+		return s
+	}
+	if err := json.Unmarshal([]byte(vi.V), &s); err != nil {
+		cs.logger.Printf("Bad set slot: %v->%v: %v", p, name, err)
+	}
+	return s
+}
+
+// writeSetSlot replaces our own slot of set name with s.
+// Must be called with the write lock held.
+func (cs *clusterState) writeSetSlot(name string, s setSlot) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		cs.logger.Printf("Could not encode set slot: %v: %v", name, err)
+		return
+	}
+	cs.write(setPrefix+name, string(b), 0)
+}
+
+// removed returns every tag of set name that some node has removed.
+// Must be called with the read lock held.
+func (cs *clusterState) removed(name string) map[writeTag]bool {
+	out := map[writeTag]bool{}
+	for p := range cs.nodes {
+		for _, t := range cs.setSlot(p, name).R {
+			out[t] = true
+		}
+	}
+	return out
+}
+
+// Add adds elem to set name.
+func (cs *clusterState) Add(name, elem string) {
+	cs.update(func() error {
+		s := cs.setSlot(cs.self, name)
+		if s.A == nil {
+			s.A = map[string][]int{}
+		}
+		// tagged by the clock of the write that carries it
+		s.A[elem] = append(s.A[elem], cs.nodes[cs.self].clock+1)
+		cs.writeSetSlot(name, s)
+		return nil
+	})
+}
+
+// Remove removes elem from set name, as far as we have seen it added.
+// An add on another node that we have not seen yet is not undone.
+func (cs *clusterState) Remove(name, elem string) error {
+	return cs.update(func() error {
+		own := cs.setSlot(cs.self, name)
+		removed := cs.removed(name)
+		found := false
+		for p, ns := range cs.nodes {
+			if p == cs.self {
+				continue
+			}
+			for _, c := range cs.setSlot(p, name).A[elem] {
+				t := writeTag{P: p, I: ns.incarnation, C: c}
+				if !removed[t] {
+					own.R = append(own.R, t)
+					found = true
+				}
+			}
+		}
+		if len(own.A[elem]) > 0 {
+			// our own adds can simply be forgotten
+			delete(own.A, elem)
+			found = true
+		}
+		if !found {
+			return ErrKeyNotFound
+		}
+		cs.pruneRemoved(name, &own)
+		cs.writeSetSlot(name, own)
+		return nil
+	})
+}
+
+// Members returns the elements of set name, in order.
+func (cs *clusterState) Members(name string) []string {
+	// get read lock
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+	removed := cs.removed(name)
+	members := []string{}
+	for p, ns := range cs.nodes {
+		for elem, clocks := range cs.setSlot(p, name).A {
+			for _, c := range clocks {
+				if !removed[writeTag{P: p, I: ns.incarnation, C: c}] {
+					members = append(members, elem)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(members)
+	// the same element may be added by several nodes
+	out := members[:0]
+	for i, m := range members {
+		if i == 0 || m != members[i-1] {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// isSetSlot reports whether key holds a node's slot of a set.
+func isSetSlot(key string) bool {
+	return strings.HasPrefix(key, setPrefix)
+}
+
+// ackSlot records that peer s has applied the set slot ns wrote in key at
+// clock c, or a newer one.
+func (ns *nodeState) ackSlot(key string, s mesh.PeerName, c int) {
+	if ns.slotAcks == nil {
+		ns.slotAcks = map[string]map[mesh.PeerName]int{}
+	}
+	if ns.slotAcks[key] == nil {
+		ns.slotAcks[key] = map[mesh.PeerName]int{}
+	}
+	if c > ns.slotAcks[key][s] {
+		ns.slotAcks[key][s] = c
+	}
+}
+
+// held returns every tag of set name that its adder's slot still holds.
+// Must be called with the read lock held.
+func (cs *clusterState) held(name string) map[writeTag]bool {
+	out := map[writeTag]bool{}
+	for p, ns := range cs.nodes {
+		for _, clocks := range cs.setSlot(p, name).A {
+			for _, c := range clocks {
+				out[writeTag{P: p, I: ns.incarnation, C: c}] = true
+			}
+		}
+	}
+	return out
+}
+
+// retracted reports whether every peer has applied a slot of set name
+// from the adder of t at least as new as ours, which no longer holds t.
+// Must be called with the read lock held.
+func (cs *clusterState) retracted(name string, t writeTag) bool {
+	ns := cs.nodes[t.P]
+	if ns == nil || ns.incarnation != t.I {
+		// gone with the rest of that life of the node
+		return true
+	}
+	key := setPrefix + name
+	c := 0
+	if vi := ns.set[key]; vi != nil {
+		c = vi.C
+	}
+	return cs.ackedByAll(t.P, func(p mesh.PeerName) bool { return ns.slotAcks[key][p] >= c })
+}
+
+// pruneRemoved drops the tags removed in s that their adder's slot no
+// longer holds, once every peer has seen that, as they can no longer hide
+// anything. It reports whether any were dropped.
+// Must be called with the read lock held.
+func (cs *clusterState) pruneRemoved(name string, s *setSlot) bool {
+	if len(s.R) == 0 {
+		return false
+	}
+	held := cs.held(name)
+	kept := s.R[:0]
+	for _, t := range s.R {
+		if held[t] || !cs.retracted(name, t) {
+			kept = append(kept, t)
+		}
+	}
+	pruned := len(kept) < len(s.R)
+	s.R = kept
+	if len(s.R) == 0 {
+		s.R = nil
+	}
+	return pruned
+}
+
+// pruneSet forgets those of our own adds to the set held in key that
+// another node has removed, so they no longer depend on its slot, and
+// those of our removes whose adds every peer has seen retracted.
+// Must be called with the write lock held.
+func (cs *clusterState) pruneSet(key string) {
+	if !isSetSlot(key) {
+		return
+	}
+	name := strings.TrimPrefix(key, setPrefix)
+	own := cs.setSlot(cs.self, name)
+	if len(own.A) == 0 && len(own.R) == 0 {
+		return
+	}
+	removed := cs.removed(name)
+	incarnation := cs.nodes[cs.self].incarnation
+	pruned := false
+	for elem, clocks := range own.A {
+		kept := clocks[:0]
+		for _, c := range clocks {
+			if removed[writeTag{P: cs.self, I: incarnation, C: c}] {
+				pruned = true
+			} else {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == 0 {
+			delete(own.A, elem)
+		} else {
+			own.A[elem] = kept
+		}
+	}
+	if cs.pruneRemoved(name, &own) {
+		pruned = true
+	}
+	if pruned {
+		cs.logger.Printf("Pruned removed elements from set %v", name)
+		cs.writeSetSlot(name, own)
+	}
+}
@@ -0,0 +1,128 @@
+package gkv
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestStateORSet(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	a := newClusterState(1, logger)
+	b := newClusterState(2, logger)
+	// exchange deltas until both are quiet
+	exchange := func() {
+		for i := 0; i < 3; i++ {
+			if d := a.takeDeltas(); d != nil {
+				b.Merge(d)
+			}
+			if d := b.takeDeltas(); d != nil {
+				a.Merge(d)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		description string
+		op          func()
+		want        []string
+	}{
+		{"adds on both nodes", func() { a.Add("s", "x"); b.Add("s", "y"); a.Add("s", "y") }, []string{"x", "y"}},
+		{"remove an element added by another node", func() { b.Remove("s", "x") }, []string{"y"}},
+		{"remove an element added by both nodes", func() { a.Remove("s", "y") }, []string{}},
+		{"re-add", func() { b.Add("s", "x") }, []string{"x"}},
+		{"concurrent add survives remove", func() { a.Remove("s", "x"); b.Add("s", "x") }, []string{"x"}},
+		{"concurrent removes", func() { a.Remove("s", "x"); b.Remove("s", "x") }, []string{}},
+		{"other sets untouched", func() { a.Add("t", "z") }, []string{}},
+	} {
+		tc.op()
+		exchange()
+		if ma, mb := a.Members("s"), b.Members("s"); !reflect.DeepEqual(ma, tc.want) || !reflect.DeepEqual(mb, tc.want) {
+			t.Errorf("Failed test for: %s (Members())", tc.description)
+			t.Errorf("Check Members() failed:\nWanted: %v\nGot: %v %v", tc.want, ma, mb)
+		} else {
+			t.Logf("Passed test for: %s (Members())", tc.description)
+		}
+	}
+	if err := a.Remove("s", "missing"); err != ErrKeyNotFound {
+		t.Errorf("Check Remove() failed: wanted %v, got %v", ErrKeyNotFound, err)
+	}
+	// removed adds are pruned from their owner's slot
+	if s := b.setSlot(2, "s"); len(s.A) != 0 {
+		t.Errorf("Check pruneSet() failed: %v", s.A)
+	}
+	// and so are removes of adds their owner has forgotten
+	for _, cs := range []*clusterState{a, b} {
+		if s := cs.setSlot(cs.self, "s"); len(s.R) != 0 {
+			t.Errorf("Check pruneSet() failed: removes kept by %v: %v", cs.self, s.R)
+		}
+	}
+	if kvs, _ := a.Keys(1); len(kvs) != 0 {
+		t.Errorf("Check Keys() failed: set slots visible: %v", kvs)
+	}
+}
+
+func TestStateORSetRetraction(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	a := newClusterState(1, logger)
+	b := newClusterState(2, logger)
+	c := newClusterState(3, logger)
+	all := []*clusterState{a, b, c}
+	for _, cs := range all {
+		cs.members = map[mesh.PeerName]bool{1: true, 2: true, 3: true}
+	}
+	// deliver sends what from has queued to each of to
+	deliver := func(from *clusterState, to ...*clusterState) {
+		if batch := from.takeDeltas(); batch != nil {
+			for _, cs := range to {
+				cs.Merge(batch)
+			}
+		}
+	}
+
+	a.Add("s", "x")
+	deliver(a, b, c)
+	b.Remove("s", "x")
+	deliver(b, a, c)
+	if m := c.Members("s"); len(m) != 0 {
+		t.Errorf("Check Members() failed after remove: %v", m)
+	}
+	// a forgets its removed add, and b relays that to c behind its own
+	// writes
+	deliver(a, b)
+	batch := b.takeDeltas()
+	own, relayed := *batch, *batch
+	own.Deltas, relayed.Deltas = nil, nil
+	for _, d := range batch.Deltas {
+		if d.P == b.self {
+			own.Deltas = append(own.Deltas, d)
+		} else {
+			relayed.Deltas = append(relayed.Deltas, d)
+		}
+	}
+	c.Merge(&own)
+	if m := c.Members("s"); len(m) != 0 {
+		t.Errorf("Failed test for: removed element stays removed (Members())")
+		t.Errorf("Check Members() failed:\nWanted: []\nGot: %v", m)
+	} else {
+		t.Logf("Passed test for: removed element stays removed (Members())")
+	}
+	c.Merge(&relayed)
+	// once everyone has seen the retraction the remove is dropped
+	for i := 0; i < 4; i++ {
+		for _, from := range all {
+			deliver(from, all...)
+		}
+	}
+	for _, cs := range all {
+		if m := cs.Members("s"); len(m) != 0 {
+			t.Errorf("Check Members() failed on %v: %v", cs.self, m)
+		}
+	}
+	if s := b.setSlot(b.self, "s"); len(s.R) != 0 {
+		t.Errorf("Check pruneSet() failed: removes kept: %v", s.R)
+	}
+}
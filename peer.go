@@ -3,8 +3,6 @@ package gkv
 import (
 	"log"
 
-	"encoding/json"
-
 	"github.com/weaveworks/mesh"
 )
 
@@ -37,31 +35,85 @@ func (p *peer) register(send mesh.Gossip) {
 	p.send = send
 }
 
+// flush sends any pending deltas.
+func (p *peer) flush() {
+	if p.send == nil {
+		return
+	}
+	p.unicast()
+	if b := p.cs.takeDeltas(); b != nil {
+		p.send.GossipBroadcast(b)
+	}
+}
+
+// unicast sends the deltas queued for single peers. Any that can't be
+// delivered are broadcast instead.
+func (p *peer) unicast() {
+	if p.send == nil {
+		return
+	}
+	for dst, deltas := range p.cs.takeDirect() {
+		for _, msg := range p.cs.singleHop(deltas).Encode() {
+			if err := p.send.GossipUnicast(dst, msg); err != nil {
+				p.logger.Printf("Unicast to %v failed, broadcasting instead: %v", dst, err)
+				p.cs.requeue(deltas)
+				break
+			}
+		}
+	}
+}
+
+// pending returns the deltas waiting to be sent, clearing them.
+func (p *peer) pending() mesh.GossipData {
+	if b := p.cs.takeDeltas(); b != nil {
+		return b
+	}
+	return nil
+}
+
 // Return a copy of our complete state.
+// Pending deltas stay queued, as this may be sent to a single peer.
 func (p *peer) Gossip() (complete mesh.GossipData) {
-	return p.cs.copyDeltas()
+	return p.cs.completeState()
 }
 
 // Merge the gossiped data represented by buf into our state.
 // Return the state information that was modified.
 func (p *peer) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
-	deltas := clusterState{}
-	err = json.Unmarshal(buf, &deltas)
-	if err != nil {
-		return nil, err
-	}
-
-	return p.cs.Merge(&deltas), nil
+	return p.receive(mesh.UnknownPeerName, buf)
 }
 
 // Merge the gossiped data represented by buf into our state.
 // Return the state information that was modified.
 func (p *peer) OnGossipBroadcast(src mesh.PeerName, buf []byte) (received mesh.GossipData, err error) {
-	return p.OnGossip(buf)
+	return p.receive(src, buf)
 }
 
 // Merge the gossiped data represented by buf into our state.
 func (p *peer) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
-	_, err := p.OnGossip(buf)
-	return err
+	delta, err := p.receive(src, buf)
+	if err != nil {
+		return err
+	}
+	// unicast data is not relayed by mesh, so send on anything it caused
+	if delta != nil && p.send != nil {
+		p.send.GossipBroadcast(delta)
+	}
+	return nil
+}
+
+// receive merges the gossiped data represented by buf, sent by src if
+// known, into our state. Answers meant for single peers are sent
+// straight away; the rest is returned.
+func (p *peer) receive(src mesh.PeerName, buf []byte) (delta mesh.GossipData, err error) {
+	deltas := clusterState{}
+	err = decode(buf, &deltas)
+	if err != nil {
+		return nil, err
+	}
+	deltas.src = src
+
+	p.cs.Merge(&deltas)
+	p.unicast()
+	return p.pending(), nil
 }
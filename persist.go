@@ -0,0 +1,243 @@
+package gkv
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	walFile      = "wal.log"
+)
+
+// wal is an append-only log of the changes applied to a clusterState
+// since its last snapshot, one JSON encoded clusterState per line.
+type wal struct {
+	f   *os.File
+	enc *json.Encoder
+	// seq counts appends; synced is the last of them flushed to disk
+	seq    uint64
+	mu     sync.Mutex
+	synced uint64
+}
+
+func openWAL(path string) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// append writes rec to the log. It is only durable once synced.
+func (w *wal) append(rec *clusterState) error {
+	if err := w.enc.Encode(rec); err != nil {
+		return err
+	}
+	atomic.AddUint64(&w.seq, 1)
+	return nil
+}
+
+// sync flushes the log to disk, unless nothing has been appended since
+// it was last flushed, so callers waiting on one sync share it.
+func (w *wal) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seq := atomic.LoadUint64(&w.seq)
+	if seq == w.synced {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.synced = seq
+	return nil
+}
+
+// truncate empties the log, once its contents are in a snapshot.
+func (w *wal) truncate() error {
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := w.f.Seek(0, io.SeekStart)
+	return err
+}
+
+func (w *wal) close() error {
+	return w.f.Close()
+}
+
+// record appends rec to the write-ahead log, if we have one.
+// Must be called with the write lock held.
+func (cs *clusterState) record(rec *clusterState) {
+	if cs.wal == nil {
+		return
+	}
+	if err := cs.wal.append(rec); err != nil {
+		cs.logger.Printf("Error appending to WAL: %v", err)
+	}
+}
+
+// update makes a change with the write lock held, returning its error,
+// then syncs the WAL once the lock is released.
+func (cs *clusterState) update(change func() error) error {
+	defer cs.syncWAL()
+	// get write lock
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	return change()
+}
+
+// syncWAL flushes the write-ahead log to disk, if we have one. It is
+// called once the write lock has been released, so a slow disk doesn't
+// hold up gossip. Must be called without the lock held.
+func (cs *clusterState) syncWAL() {
+	// get read lock
+	cs.mtx.RLock()
+	w := cs.wal
+	cs.mtx.RUnlock()
+	if w == nil {
+		return
+	}
+	if err := w.sync(); err != nil {
+		cs.logger.Printf("Error syncing WAL: %v", err)
+	}
+}
+
+// openStore restores cs from the snapshot and WAL in dir, if any,
+// then starts logging to the WAL. It should be called before any
+// gossip is received.
+func (cs *clusterState) openStore(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := cs.restore(dir); err != nil {
+		return err
+	}
+	w, err := openWAL(filepath.Join(dir, walFile))
+	if err != nil {
+		return err
+	}
+	// get write lock
+	cs.mtx.Lock()
+	cs.dir = dir
+	cs.wal = w
+	cs.mtx.Unlock()
+	// our incarnation must be on disk before anything in the WAL
+	return cs.saveSnapshot()
+}
+
+// restore loads the snapshot in dir, then replays the WAL over it.
+func (cs *clusterState) restore(dir string) error {
+	// get write lock
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	f, err := os.Open(filepath.Join(dir, snapshotFile))
+	if err == nil {
+		states := map[mesh.PeerName]*nodeSnapshot{}
+		err = json.NewDecoder(f).Decode(&states)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for p, s := range states {
+			ns := newNodeState(p, s.Incarnation)
+			for _, r := range s.Missed {
+				ns.miss(r[0], r[1])
+			}
+			ns.advance(s.Clock)
+			for k, vi := range s.Set {
+				ns.put(k, vi.copy())
+				cs.hlc.update(vi.T, time.Now())
+			}
+			cs.nodes[p] = ns
+		}
+		cs.logger.Printf("Restored snapshot of %v nodes, clock %v", len(states), cs.nodes[cs.self].clock)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err = os.Open(filepath.Join(dir, walFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	n := 0
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a torn final record is dropped
+			break
+		} else if err != nil {
+			return err
+		}
+		rec := clusterState{}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		cs.merge(&rec)
+		n++
+	}
+	// replaying must not gossip anything
+	cs.clearQueue()
+	cs.logger.Printf("Replayed %v WAL records, clock %v", n, cs.nodes[cs.self].clock)
+	return nil
+}
+
+// saveSnapshot writes the state of every node to disk and truncates the
+// WAL. The write lock is held throughout so no record can be lost.
+func (cs *clusterState) saveSnapshot() error {
+	// get write lock
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	if cs.wal == nil {
+		return nil
+	}
+	path := filepath.Join(cs.dir, snapshotFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(cs.snapshot()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return cs.wal.truncate()
+}
+
+// closeStore takes a final snapshot and closes the WAL.
+func (cs *clusterState) closeStore() error {
+	if err := cs.saveSnapshot(); err != nil {
+		return err
+	}
+	// get write lock
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	if cs.wal == nil {
+		return nil
+	}
+	err := cs.wal.close()
+	cs.wal = nil
+	return err
+}
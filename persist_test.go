@@ -0,0 +1,111 @@
+package gkv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/weaveworks/mesh"
+)
+
+func TestStateRestore(t *testing.T) {
+	logger := log.New(os.Stdout, "TEST ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	dir, err := ioutil.TempDir("", "gkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		description string
+		snapshot    bool
+	}{
+		{"WAL only", false},
+		{"snapshot and WAL", true},
+	} {
+		os.RemoveAll(dir)
+		cs := newClusterState(1, logger)
+		if err := cs.openStore(dir); err != nil {
+			t.Fatal(err)
+		}
+		cs.Set("k1", "v1")
+		cs.Merge(&clusterState{Deltas: []delta{
+			delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 1, V: "v1"}},
+			delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 3, V: "v3"}},
+		}})
+		if tc.snapshot {
+			if err := cs.saveSnapshot(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cs.Set("k2", "v2")
+		cs.Delete("k1")
+		cs.wal.close()
+
+		restored := newClusterState(1, logger)
+		if err := restored.openStore(dir); err != nil {
+			t.Fatal(err)
+		}
+		restored.wal.close()
+		cs.Deltas = nil
+		if !csDeepEquals(*restored, *cs) {
+			t.Errorf("Failed test for: %s (restore)", tc.description)
+			t.Errorf("Check restore failed:\nWanted: %s\nGot: %s", spew.Sdump(cs.nodes), spew.Sdump(restored.nodes))
+		} else {
+			t.Logf("Passed test for: %s (restore)", tc.description)
+		}
+	}
+}
+
+func TestStateRecordApplied(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "gkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cs := newClusterState(1, logger)
+	if err := cs.openStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer cs.closeStore()
+	update := delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 1, V: "v1"}}
+	for _, tc := range []struct {
+		description string
+		in          clusterState
+		records     int
+	}{
+		{"update", clusterState{Deltas: []delta{update}}, 1},
+		{"repeated update", clusterState{Deltas: []delta{update}}, 1},
+		{"complete state", clusterState{States: map[mesh.PeerName]*nodeSnapshot{
+			123: &nodeSnapshot{Clock: 1, Set: map[string]valueInstance{"k1": update.Vi}},
+		}}, 1},
+		{"newer complete state", clusterState{States: map[mesh.PeerName]*nodeSnapshot{
+			123: &nodeSnapshot{Clock: 4, Set: map[string]valueInstance{"k1": valueInstance{C: 4, V: "v4"}}},
+		}}, 2},
+	} {
+		cs.Merge(&tc.in)
+		b, err := ioutil.ReadFile(filepath.Join(dir, walFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := bytes.Count(b, []byte("\n")); n != tc.records {
+			t.Errorf("Failed test for: %s (wanted %v WAL records, got %v)", tc.description, tc.records, n)
+		} else {
+			t.Logf("Passed test for: %s (WAL records)", tc.description)
+		}
+	}
+	// replaying the complete state leaves no gaps the live node never had
+	restored := newClusterState(1, logger)
+	if err := restored.restore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if ns := restored.nodes[123]; ns == nil || ns.clock != 4 || len(ns.gaps()) != 0 {
+		t.Errorf("Check restore failed: %s", spew.Sdump(ns))
+	}
+}
@@ -0,0 +1,189 @@
+package gkv
+
+import (
+	"sort"
+
+	"github.com/weaveworks/mesh"
+)
+
+// DropPolicy decides what is discarded when the outbound delta queue is
+// full.
+type DropPolicy int
+
+const (
+	// DropOldest discards the longest queued delta that may be dropped
+	// to make room.
+	DropOldest DropPolicy = iota
+	// DropNewest discards the delta being queued.
+	DropNewest
+)
+
+// queueKey identifies deltas that can be coalesced in the queue.
+type queueKey struct {
+	kind byte
+	p    mesh.PeerName
+	k    string
+	c    int
+	s    mesh.PeerName
+}
+
+const (
+	queueUpdate byte = iota
+	queueFix
+	queueAck
+	queueSup
+	queueGone
+)
+
+func (d delta) queueKey() queueKey {
+	switch {
+	case d.Fix:
+		return queueKey{kind: queueFix, p: d.P, c: d.Vi.C, s: d.S}
+	case d.Ack:
+		return queueKey{kind: queueAck, p: d.P, k: d.K, c: d.Vi.C, s: d.S}
+	case d.Sup:
+		return queueKey{kind: queueSup, p: d.P, c: d.Vi.C}
+	case d.Gone:
+		return queueKey{kind: queueGone, p: d.P}
+	}
+	return queueKey{kind: queueUpdate, p: d.P, k: d.K}
+}
+
+// newer reports whether d carries a later write than o.
+func (d delta) newer(o delta) bool {
+	if d.I != o.I {
+		return d.I > o.I
+	}
+	return d.Vi.C > o.Vi.C
+}
+
+// supersedes returns the clocks d covers once it replaces o in the
+// queue: its own Prior and, from the same incarnation, o and o's Prior.
+func (d delta) supersedes(o delta) []int {
+	if d.I != o.I {
+		return d.Prior
+	}
+	clocks := make([]int, 0, len(d.Prior)+len(o.Prior)+1)
+	clocks = append(clocks, d.Prior...)
+	clocks = append(clocks, o.Prior...)
+	clocks = append(clocks, o.Vi.C)
+	sort.Ints(clocks)
+	out := clocks[:0]
+	for i, c := range clocks {
+		if c != d.Vi.C && (i == 0 || c != clocks[i-1]) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// enqueue adds d to the outbound deltas. Only the newest update of each
+// key is kept, and a repair request, ack or superseded answer already
+// queued absorbs any repeat of it. If the queue is full an update,
+// superseded answer or departure is dropped according to cs.drop. Must be called with the write lock held.
+func (cs *clusterState) enqueue(d delta) {
+	key := d.queueKey()
+	if cs.queued == nil {
+		cs.indexQueue()
+	}
+	if i, ok := cs.queued[key]; ok && i < len(cs.Deltas) && cs.Deltas[i].queueKey() == key {
+		q := &cs.Deltas[i]
+		switch {
+		case key.kind == queueUpdate && d.newer(*q):
+			d.Prior = d.supersedes(*q)
+			*q = d
+		case key.kind == queueUpdate && q.newer(d):
+			// already sending something newer
+			q.Prior = q.supersedes(d)
+		default:
+			// same delta, or a request for the same clocks: widen it
+			if d.Ttl > q.Ttl {
+				q.Ttl = d.Ttl
+			}
+			if d.last() > q.last() {
+				q.To = d.last()
+			}
+		}
+		return
+	}
+	if cs.maxQueue > 0 && d.optional() && cs.optional >= cs.maxQueue {
+		if cs.drop == DropNewest {
+			cs.logger.Printf("Delta queue full, dropped newest: %v->%v->%v", d.P, d.K, d.Vi.C)
+			return
+		}
+		cs.dropOldest()
+	}
+	cs.queued[key] = len(cs.Deltas)
+	cs.Deltas = append(cs.Deltas, d)
+	if d.optional() {
+		cs.optional++
+	}
+}
+
+// optional reports whether d may be dropped when the queue is full.
+// Acks and repair requests are not sent again, so they never are.
+func (d delta) optional() bool {
+	return !d.Ack && !d.Fix
+}
+
+// dropOldest discards the longest queued delta that may be dropped.
+// It is left in place with a Ttl of 0, which no queued delta otherwise
+// has, until half the queue has been dropped and it is compacted.
+// Must be called with the write lock held.
+func (cs *clusterState) dropOldest() {
+	for !cs.Deltas[cs.oldest].optional() || cs.Deltas[cs.oldest].Ttl == 0 {
+		cs.oldest++
+	}
+	o := &cs.Deltas[cs.oldest]
+	cs.logger.Printf("Delta queue full, dropped oldest: %v->%v->%v", o.P, o.K, o.Vi.C)
+	delete(cs.queued, o.queueKey())
+	o.Ttl = 0
+	cs.optional--
+	cs.dropped++
+	if cs.dropped*2 >= len(cs.Deltas) {
+		cs.compactQueue()
+	}
+}
+
+// compactQueue removes dropped deltas from the queue.
+// Must be called with the write lock held.
+func (cs *clusterState) compactQueue() {
+	if cs.dropped == 0 {
+		return
+	}
+	cs.Deltas = cs.liveDeltas()
+	cs.dropped, cs.oldest = 0, 0
+	// positions have shifted
+	cs.indexQueue()
+}
+
+// indexQueue rebuilds the index of queued deltas by queue key.
+// Must be called with the write lock held.
+func (cs *clusterState) indexQueue() {
+	cs.queued = make(map[queueKey]int, len(cs.Deltas)+1)
+	for i, q := range cs.Deltas {
+		cs.queued[q.queueKey()] = i
+	}
+}
+
+// liveDeltas returns the queued deltas that have not been dropped.
+// Must be called with the read lock held.
+func (cs *clusterState) liveDeltas() []delta {
+	if cs.dropped == 0 {
+		return cs.Deltas[:len(cs.Deltas):len(cs.Deltas)]
+	}
+	live := make([]delta, 0, len(cs.Deltas)-cs.dropped)
+	for _, d := range cs.Deltas {
+		if d.Ttl > 0 {
+			live = append(live, d)
+		}
+	}
+	return live
+}
+
+// clearQueue empties the queue once its deltas have been taken.
+// Must be called with the write lock held.
+func (cs *clusterState) clearQueue() {
+	cs.Deltas, cs.queued = nil, nil
+	cs.optional, cs.dropped, cs.oldest = 0, 0, 0
+}
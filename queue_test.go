@@ -0,0 +1,137 @@
+package gkv
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestStateEnqueue(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+
+	for _, tc := range []struct {
+		description string
+		maxQueue    int
+		drop        DropPolicy
+		compact     int // compact the queue after this many deltas
+		in          []delta
+		want        []delta
+	}{
+		{
+			"newest update per key",
+			0, DropOldest, 0,
+			[]delta{
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 2, V: "v2"}},
+				delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 3, V: "v3"}},
+				delta{P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 1, V: "v1"}},
+				delta{P: 123, Ttl: 1, K: "k1", Vi: valueInstance{C: 4, V: "v4"}},
+				delta{P: 124, Ttl: 3, K: "k1", Vi: valueInstance{C: 1, V: "v1"}},
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 1, V: "v1"}, I: 2},
+			},
+			[]delta{
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 1, V: "v1"}, I: 2},
+				delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 3, V: "v3"}},
+				delta{P: 124, Ttl: 3, K: "k1", Vi: valueInstance{C: 1, V: "v1"}},
+			},
+		},
+		{
+			"one repair request per clock",
+			0, DropOldest, 0,
+			[]delta{
+				delta{Fix: true, P: 123, Ttl: 2, Vi: valueInstance{C: 2}},
+				delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 2}, To: 4},
+				delta{Fix: true, P: 123, Ttl: 1, Vi: valueInstance{C: 2}, To: 3},
+				delta{Ack: true, P: 123, S: 124, Ttl: 3, K: "k1", Vi: valueInstance{C: 2}},
+				delta{Ack: true, P: 123, S: 124, Ttl: 2, K: "k1", Vi: valueInstance{C: 2}},
+			},
+			[]delta{
+				delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 2}, To: 4},
+				delta{Ack: true, P: 123, S: 124, Ttl: 3, K: "k1", Vi: valueInstance{C: 2}},
+			},
+		},
+		{
+			"full queue, drop oldest",
+			2, DropOldest, 0,
+			[]delta{
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 1, V: "v1"}},
+				delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 2, V: "v2"}},
+				delta{P: 123, Ttl: 3, K: "k3", Vi: valueInstance{C: 3, V: "v3"}},
+				delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 4, V: "v4"}},
+			},
+			[]delta{
+				delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 4, V: "v4"}, Prior: []int{2}},
+				delta{P: 123, Ttl: 3, K: "k3", Vi: valueInstance{C: 3, V: "v3"}},
+			},
+		},
+		{
+			"full queue, drop newest",
+			2, DropNewest, 0,
+			[]delta{
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 1, V: "v1"}},
+				delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 2, V: "v2"}},
+				delta{P: 123, Ttl: 3, K: "k3", Vi: valueInstance{C: 3, V: "v3"}},
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 4, V: "v4"}},
+			},
+			[]delta{
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 4, V: "v4"}, Prior: []int{1}},
+				delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 2, V: "v2"}},
+			},
+		},
+		{
+			"full queue, acks and repair requests are never dropped",
+			2, DropOldest, 0,
+			[]delta{
+				delta{Ack: true, P: 123, S: 124, Ttl: 3, K: "k1", Vi: valueInstance{C: 2}},
+				delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 5}},
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 6, V: "v6"}},
+				delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 7, V: "v7"}},
+				delta{P: 123, Ttl: 3, K: "k3", Vi: valueInstance{C: 8, V: "v8"}},
+				delta{Ack: true, P: 124, S: 123, Ttl: 3, K: "k9", Vi: valueInstance{C: 1}},
+			},
+			[]delta{
+				delta{Ack: true, P: 123, S: 124, Ttl: 3, K: "k1", Vi: valueInstance{C: 2}},
+				delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 5}},
+				delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 7, V: "v7"}},
+				delta{P: 123, Ttl: 3, K: "k3", Vi: valueInstance{C: 8, V: "v8"}},
+				delta{Ack: true, P: 124, S: 123, Ttl: 3, K: "k9", Vi: valueInstance{C: 1}},
+			},
+		},
+		{
+			"full queue, update coalesced after compaction",
+			4, DropOldest, 5,
+			[]delta{
+				delta{P: 123, Ttl: 3, K: "a", Vi: valueInstance{C: 1, V: "v1"}},
+				delta{P: 123, Ttl: 3, K: "b", Vi: valueInstance{C: 2, V: "v2"}},
+				delta{P: 123, Ttl: 3, K: "c", Vi: valueInstance{C: 3, V: "v3"}},
+				delta{P: 123, Ttl: 3, K: "d", Vi: valueInstance{C: 4, V: "v4"}},
+				delta{P: 123, Ttl: 3, K: "e", Vi: valueInstance{C: 5, V: "v5"}},
+				delta{P: 123, Ttl: 3, K: "b", Vi: valueInstance{C: 9, V: "v9"}},
+			},
+			[]delta{
+				delta{P: 123, Ttl: 3, K: "b", Vi: valueInstance{C: 9, V: "v9"}, Prior: []int{2}},
+				delta{P: 123, Ttl: 3, K: "c", Vi: valueInstance{C: 3, V: "v3"}},
+				delta{P: 123, Ttl: 3, K: "d", Vi: valueInstance{C: 4, V: "v4"}},
+				delta{P: 123, Ttl: 3, K: "e", Vi: valueInstance{C: 5, V: "v5"}},
+			},
+		},
+	} {
+		cs := clusterState{logger: logger, mtx: &sync.RWMutex{}, maxQueue: tc.maxQueue, drop: tc.drop}
+		for i, d := range tc.in {
+			if i > 0 && i == tc.compact {
+				cs.compactQueue()
+			}
+			cs.enqueue(d)
+		}
+		cs.compactQueue()
+		if !reflect.DeepEqual(cs.Deltas, tc.want) {
+			t.Errorf("Failed test for: %s (enqueue())", tc.description)
+			t.Errorf("Check enqueue() failed:\nWanted: %s\nGot: %s", spew.Sdump(tc.want), spew.Sdump(cs.Deltas))
+		} else {
+			t.Logf("Passed test for: %s (enqueue())", tc.description)
+		}
+	}
+}
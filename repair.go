@@ -0,0 +1,124 @@
+package gkv
+
+import (
+	"time"
+)
+
+// RepairPolicy controls how missed clocks are re-requested.
+// A repair request is sent as soon as a gap is noticed; if the gap is
+// still open after Backoff it is requested again, waiting twice as long
+// each time up to MaxBackoff. After MaxAttempts requests the gap is
+// abandoned.
+type RepairPolicy struct {
+	// Interval is how often outstanding gaps are checked.
+	Interval time.Duration
+	// Backoff is how long to wait before the first re-request.
+	Backoff time.Duration
+	// MaxBackoff caps the wait between re-requests.
+	MaxBackoff time.Duration
+	// MaxAttempts is how many requests are made before giving up.
+	MaxAttempts int
+}
+
+// DefaultRepairPolicy is used for any RepairPolicy field left zero.
+var DefaultRepairPolicy = RepairPolicy{
+	Interval:    time.Second,
+	Backoff:     time.Second,
+	MaxBackoff:  time.Minute,
+	MaxAttempts: 10,
+}
+
+// withDefaults fills in zero fields of rp from DefaultRepairPolicy.
+func (rp RepairPolicy) withDefaults() RepairPolicy {
+	if rp.Interval == 0 {
+		rp.Interval = DefaultRepairPolicy.Interval
+	}
+	if rp.Backoff == 0 {
+		rp.Backoff = DefaultRepairPolicy.Backoff
+	}
+	if rp.MaxBackoff == 0 {
+		rp.MaxBackoff = DefaultRepairPolicy.MaxBackoff
+	}
+	if rp.MaxAttempts == 0 {
+		rp.MaxAttempts = DefaultRepairPolicy.MaxAttempts
+	}
+	return rp
+}
+
+// backoff returns how long to wait after the given number of attempts.
+func (rp RepairPolicy) backoff(attempts int) time.Duration {
+	d := rp.Backoff
+	for i := 1; i < attempts && d < rp.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	return d
+}
+
+// RepairStats counts the work of the repair scheduler.
+type RepairStats struct {
+	// Retried is how many missed clocks have been requested again.
+	Retried uint64
+	// Abandoned is how many missed clocks were given up on.
+	Abandoned uint64
+}
+
+// retry tracks the repair requests made for one run of missed clocks.
+type retry struct {
+	attempts int
+	next     time.Time
+}
+
+// retryRepairs re-requests every run of missed clocks that is due, and
+// abandons those that have had MaxAttempts requests already.
+func (cs *clusterState) retryRepairs(now time.Time, rp RepairPolicy) {
+	// get write lock
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	for p, ns := range cs.nodes {
+		if ns.retries == nil {
+			ns.retries = map[int]*retry{}
+		}
+		// forget runs that have been repaired
+		for c := range ns.retries {
+			if !ns.missing(c) {
+				delete(ns.retries, c)
+			}
+		}
+		for _, g := range ns.gaps() {
+			n := uint64(g[1] - g[0] + 1)
+			r := ns.retries[g[0]]
+			if r == nil {
+				// the first request went out when the gap was noticed
+				ns.retries[g[0]] = &retry{attempts: 1, next: now.Add(rp.backoff(1))}
+				continue
+			}
+			if now.Before(r.next) {
+				continue
+			}
+			if r.attempts >= rp.MaxAttempts {
+				cs.logger.Printf("Abandoned repair of clocks %v-%v for node %v after %v attempts", g[0], g[1], p, r.attempts)
+				ns.recoverRange(g[0], g[1])
+				delete(ns.retries, g[0])
+				cs.stats.Abandoned += n
+				cs.publish(Event{Type: EventAbandon, Peer: p, Clock: g[0]})
+				continue
+			}
+			r.attempts++
+			r.next = now.Add(rp.backoff(r.attempts))
+			cs.logger.Printf("Re-requesting missed clocks %v-%v for node %v", g[0], g[1], p)
+			cs.sendTo(p, cs.repairRequest(p, ns.incarnation, g[0], g[1]))
+			cs.stats.Retried += n
+		}
+	}
+}
+
+// RepairStats returns the repair scheduler's counters.
+func (cs *clusterState) RepairStats() RepairStats {
+	// get read lock
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+	return cs.stats
+}
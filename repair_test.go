@@ -0,0 +1,105 @@
+package gkv
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/weaveworks/mesh"
+)
+
+func TestStateRetryRepairs(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	rp := RepairPolicy{Backoff: time.Second, MaxBackoff: 2 * time.Second, MaxAttempts: 3}
+	cs := clusterState{
+		logger: logger,
+		mtx:    &sync.RWMutex{},
+		nodes: map[mesh.PeerName]*nodeState{
+			123: &nodeState{
+				self:        123,
+				incarnation: 7,
+				set:         map[string]*valueInstance{},
+				clock:       6,
+				missed:      [][2]int{{2, 3}, {5, 5}},
+			}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	events := cs.Watch(ctx, mesh.UnknownPeerName, "")
+	t0 := time.Now()
+
+	for _, tc := range []struct {
+		description string
+		now         time.Time
+		deltas      []delta
+		stats       RepairStats
+	}{
+		{"gaps noticed, first request already sent", t0, nil, RepairStats{}},
+		{"not yet due", t0.Add(500 * time.Millisecond), nil, RepairStats{}},
+		{"second request, as runs", t0.Add(time.Second), []delta{
+			delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 2}, I: 7, To: 3},
+			delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 5}, I: 7},
+		}, RepairStats{Retried: 3}},
+		{"backed off", t0.Add(2 * time.Second), nil, RepairStats{Retried: 3}},
+		{"third request", t0.Add(3 * time.Second), []delta{
+			delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 2}, I: 7, To: 3},
+			delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 5}, I: 7},
+		}, RepairStats{Retried: 6}},
+		{"abandoned", t0.Add(5 * time.Second), nil, RepairStats{Retried: 6, Abandoned: 3}},
+	} {
+		cs.Deltas = nil
+		cs.retryRepairs(tc.now, rp)
+		if !reflect.DeepEqual(cs.Deltas, tc.deltas) || cs.RepairStats() != tc.stats {
+			t.Errorf("Failed test for: %s (retryRepairs())", tc.description)
+			t.Errorf("Check retryRepairs() failed:\nWanted: %s %+v\nGot: %s %+v", spew.Sdump(tc.deltas), tc.stats, spew.Sdump(cs.Deltas), cs.RepairStats())
+		}
+	}
+	cancel()
+	var abandoned []int
+	for e := range events {
+		if e.Type == EventAbandon && e.Peer == 123 {
+			abandoned = append(abandoned, e.Clock)
+		}
+	}
+	if want := []int{2, 5}; !reflect.DeepEqual(abandoned, want) {
+		t.Errorf("Check EventAbandon failed: wanted %v, got %v", want, abandoned)
+	}
+	if gaps := cs.nodes[123].gaps(); gaps != nil {
+		t.Errorf("Check abandon failed: clocks %v still missed", gaps)
+	}
+}
+
+func TestStateAnswerRepairRange(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	cs := clusterState{
+		self:   1,
+		logger: logger,
+		mtx:    &sync.RWMutex{},
+		nodes: map[mesh.PeerName]*nodeState{
+			123: &nodeState{
+				self:   123,
+				set:    map[string]*valueInstance{"k1": &valueInstance{C: 3, V: "v3"}},
+				clock:  5,
+				missed: [][2]int{{5, 5}},
+			}}}
+	start := time.Now()
+	cs.merge(&clusterState{Deltas: []delta{
+		delta{Fix: true, P: 123, S: 124, Ttl: 3, Vi: valueInstance{C: 1}, To: 1000000000},
+	}})
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Check answerRepair() failed: took %v", d)
+	}
+	want := []delta{
+		delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 3, V: "v3"}},
+		delta{Sup: true, P: 123, Ttl: 3, Vi: valueInstance{C: 1}, To: 2},
+		delta{Sup: true, P: 123, Ttl: 3, Vi: valueInstance{C: 4}},
+		delta{Fix: true, P: 123, S: 124, Ttl: 2, Vi: valueInstance{C: 5}},
+		delta{Fix: true, P: 123, S: 124, Ttl: 2, Vi: valueInstance{C: 6}, To: 1000000000},
+	}
+	if !reflect.DeepEqual(cs.Deltas, want) {
+		t.Errorf("Check answerRepair() failed:\nWanted: %s\nGot: %s", spew.Sdump(want), spew.Sdump(cs.Deltas))
+	}
+}
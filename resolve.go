@@ -0,0 +1,132 @@
+package gkv
+
+import (
+	"sort"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Version is the value one node holds for a key.
+type Version struct {
+	Key   string
+	Peer  mesh.PeerName
+	Value string
+	Clock int
+	// Stamp is when the version was written; Time is its wall time
+	Stamp   Timestamp
+	Time    time.Time
+	Deleted bool
+}
+
+// Resolver picks the version of a key that wins out of those held by
+// every node. It is given at least one version, ordered by peer.
+type Resolver func(versions []Version) Version
+
+// LastWriterWins picks the most recently written version, by timestamp,
+// breaking ties by peer name.
+func LastWriterWins(versions []Version) Version {
+	win := versions[0]
+	for _, v := range versions[1:] {
+		if v.Stamp > win.Stamp || (v.Stamp == win.Stamp && v.Peer > win.Peer) {
+			win = v
+		}
+	}
+	return win
+}
+
+// PeerPriority returns a Resolver that picks the version held by the
+// earliest of peers. Versions held by any other peer lose to them, and
+// are picked between by LastWriterWins.
+func PeerPriority(peers ...mesh.PeerName) Resolver {
+	rank := make(map[mesh.PeerName]int, len(peers))
+	for i, p := range peers {
+		rank[p] = len(peers) - i
+	}
+	return func(versions []Version) Version {
+		var best []Version
+		top := -1
+		for _, v := range versions {
+			switch r := rank[v.Peer]; {
+			case r > top:
+				best, top = []Version{v}, r
+			case r == top:
+				best = append(best, v)
+			}
+		}
+		return LastWriterWins(best)
+	}
+}
+
+// versions returns every version of key held by a node, live or deleted.
+// Must be called with the read lock held.
+func (cs *clusterState) versions(key string) []Version {
+	now := cs.now()
+	var out []Version
+	for p, ns := range cs.nodes {
+		vi := ns.set[key]
+		if vi == nil || vi.expired(now) {
+			continue
+		}
+		out = append(out, vi.version(key, p))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Peer < out[j].Peer })
+	return out
+}
+
+// version describes vi, the value p holds for key.
+func (vi *valueInstance) version(key string, p mesh.PeerName) Version {
+	return Version{
+		Key:     key,
+		Peer:    p,
+		Value:   vi.V,
+		Clock:   vi.C,
+		Stamp:   vi.T,
+		Time:    vi.T.Time(),
+		Deleted: vi.D,
+	}
+}
+
+// GetAny returns the value of key held by any node, our own if we hold
+// one. It is cheaper than GetResolved, but different nodes may disagree.
+func (cs *clusterState) GetAny(key string) (string, error) {
+	if internal(key) {
+		return "", ErrKeyNotFound
+	}
+	// get read lock
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+	now := cs.now()
+	if vi := cs.nodes[cs.self].set[key]; vi != nil && !vi.D && !vi.expired(now) {
+		return vi.V, nil
+	}
+	for _, v := range cs.versions(key) {
+		if !v.Deleted {
+			return v.Value, nil
+		}
+	}
+	return "", ErrKeyNotFound
+}
+
+// GetResolved returns the value of key, as picked by r from the versions
+// every node holds that no later write has superseded; LastWriterWins if
+// r is nil. A deletion can win, in which case the key is not found.
+func (cs *clusterState) GetResolved(key string, r Resolver) (string, error) {
+	if internal(key) {
+		return "", ErrKeyNotFound
+	}
+	// get read lock
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+	if r == nil {
+		r = LastWriterWins
+	}
+	versions := cs.frontier(key)
+	if len(versions) == 0 {
+		return "", ErrKeyNotFound
+	}
+	if v := r(versions); !v.Deleted {
+		return v.Value, nil
+	}
+	return "", ErrKeyNotFound
+}
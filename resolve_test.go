@@ -0,0 +1,97 @@
+package gkv
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestStateGetResolved(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	cs := clusterState{
+		self:   1,
+		logger: logger,
+		mtx:    &sync.RWMutex{},
+		nodes: map[mesh.PeerName]*nodeState{
+			1: &nodeState{
+				self: 1,
+				set: map[string]*valueInstance{
+					"k1": &valueInstance{C: 1, V: "mine", T: 100},
+					"k3": &valueInstance{C: 2, D: true, T: 300},
+				},
+			},
+			123: &nodeState{
+				self: 123,
+				set: map[string]*valueInstance{
+					"k1": &valueInstance{C: 4, V: "newest", T: 200},
+					"k2": &valueInstance{C: 1, V: "tied", T: 50},
+					"k3": &valueInstance{C: 1, V: "deleted since", T: 250},
+				},
+			},
+			124: &nodeState{
+				self: 124,
+				set: map[string]*valueInstance{
+					"k1": &valueInstance{C: 9, V: "oldest", T: 10},
+					"k2": &valueInstance{C: 2, V: "tied, higher peer", T: 50},
+					"k4": &valueInstance{C: 3, V: "expired", E: 1, T: 400},
+				},
+			},
+		}}
+	longest := func(versions []Version) Version {
+		win := versions[0]
+		for _, v := range versions {
+			if len(v.Value) > len(win.Value) {
+				win = v
+			}
+		}
+		return win
+	}
+
+	for _, tc := range []struct {
+		description string
+		key         string
+		resolver    Resolver
+		want        string
+		err         error
+	}{
+		{"last writer wins", "k1", nil, "newest", nil},
+		{"last writer wins, tie broken by peer", "k2", LastWriterWins, "tied, higher peer", nil},
+		{"later deletion wins", "k3", LastWriterWins, "", ErrKeyNotFound},
+		{"expired values are ignored", "k4", LastWriterWins, "", ErrKeyNotFound},
+		{"missing key", "k5", LastWriterWins, "", ErrKeyNotFound},
+		{"peer priority", "k1", PeerPriority(124, 123), "oldest", nil},
+		{"peer priority, unlisted peers by last writer", "k1", PeerPriority(2), "newest", nil},
+		{"custom", "k2", longest, "tied, higher peer", nil},
+	} {
+		got, err := cs.GetResolved(tc.key, tc.resolver)
+		if got != tc.want || err != tc.err {
+			t.Errorf("Failed test for: %s (GetResolved())", tc.description)
+			t.Errorf("Check GetResolved() failed:\nWanted: %q %v\nGot: %q %v", tc.want, tc.err, got, err)
+		} else {
+			t.Logf("Passed test for: %s (GetResolved())", tc.description)
+		}
+	}
+
+	for _, tc := range []struct {
+		description string
+		key         string
+		want        string
+		err         error
+	}{
+		{"own value first", "k1", "mine", nil},
+		{"any other node", "k2", "tied", nil},
+		{"deleted here, live elsewhere", "k3", "deleted since", nil},
+		{"missing key", "k5", "", ErrKeyNotFound},
+	} {
+		got, err := cs.GetAny(tc.key)
+		if got != tc.want || err != tc.err {
+			t.Errorf("Failed test for: %s (GetAny())", tc.description)
+			t.Errorf("Check GetAny() failed:\nWanted: %q %v\nGot: %q %v", tc.want, tc.err, got, err)
+		} else {
+			t.Logf("Passed test for: %s (GetAny())", tc.description)
+		}
+	}
+}
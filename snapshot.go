@@ -0,0 +1,189 @@
+package gkv
+
+import (
+	"github.com/weaveworks/mesh"
+)
+
+// nodeSnapshot is the complete state of one node, as gossiped to peers
+// during mesh's periodic full-state exchange. It lets newly joined peers
+// learn keys whose deltas have long since run out of Ttl.
+// A snapshot split across frames is sent as parts, each holding the
+// keys in [From, To); an empty bound is unbounded.
+type nodeSnapshot struct {
+	Incarnation int64 `json:",omitempty"`
+	Clock       int
+	Missed      [][2]int                 `json:",omitempty"`
+	Set         map[string]valueInstance `json:",omitempty"`
+	From        string                   `json:",omitempty"`
+	To          string                   `json:",omitempty"`
+}
+
+// partial reports whether s is only a part of a node's snapshot.
+func (s *nodeSnapshot) partial() bool {
+	return s.From != "" || s.To != ""
+}
+
+// covers reports whether key k falls within the keys s holds.
+func (s *nodeSnapshot) covers(k string) bool {
+	return k >= s.From && (s.To == "" || k < s.To)
+}
+
+// snapshot returns the complete state of every node we know of.
+// Must be called with the read lock held.
+func (cs *clusterState) snapshot() map[mesh.PeerName]*nodeSnapshot {
+	now := cs.now()
+	out := make(map[mesh.PeerName]*nodeSnapshot, len(cs.nodes))
+	for p, ns := range cs.nodes {
+		s := &nodeSnapshot{
+			Incarnation: ns.incarnation,
+			Clock:       ns.clock,
+			Set:         make(map[string]valueInstance, len(ns.set)),
+		}
+		s.Missed = ns.gaps()
+		for k, vi := range ns.set {
+			if !vi.expired(now) {
+				s.Set[k] = *vi
+			}
+		}
+		out[p] = s
+	}
+	return out
+}
+
+// completeState returns a batch holding the complete state of every node.
+// Pending deltas are left queued.
+func (cs *clusterState) completeState() *clusterState {
+	// get read lock
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+	out := cs.copyDeltas()
+	out.Deltas = nil
+	out.States = cs.snapshot()
+	return out
+}
+
+// mergeSnapshot brings our view of node p up to date with s.
+// Newer values are applied as repairs, and any clocks we had missed that
+// s accounts for are resolved. It reports whether our view changed.
+// Must be called with the write lock held.
+func (cs *clusterState) mergeSnapshot(p mesh.PeerName, s *nodeSnapshot) bool {
+	if p == cs.self {
+		// we are the authority on our own state, but not on which of
+		// our lives peers have seen
+		cs.outlive(s.Incarnation)
+		return false
+	}
+	if !cs.current(delta{P: p, I: s.Incarnation}) {
+		cs.logger.Printf("Snapshot: earlier incarnation %v of node %v", s.Incarnation, p)
+		return false
+	}
+	changed := false
+	ns := cs.nodes[p]
+	if ns == nil {
+		changed = true
+		cs.logger.Printf("Snapshot: new node %v at clock %v", p, s.Clock)
+		ns = newNodeState(p, s.Incarnation)
+		cs.nodes[p] = ns
+	}
+	for k, vi := range s.Set {
+		if cur := ns.set[k]; cur == nil || vi.C > cur.C {
+			d := delta{P: p, K: k, Vi: vi, I: s.Incarnation}
+			cs.logger.Printf("Snapshot: repair key: %v->%v->%v:%v", p, k, vi.C, vi.V)
+			cs.apply(d, true)
+			cs.ackWrite(d)
+			changed = true
+		}
+	}
+	// the snapshot accounts for every clock up to its own, apart from
+	// those it is missing too, so a value it accounts for but no longer
+	// holds has been collected or has expired there
+	for k, vi := range ns.set {
+		if _, ok := s.Set[k]; !ok && s.covers(k) && vi.C <= s.Clock && !within(s.Missed, vi.C) {
+			cs.logger.Printf("Snapshot: drop key: %v->%v->%v", p, k, vi.C)
+			ns.remove(k)
+			changed = true
+			if !vi.D {
+				cs.notify(EventDelete, p, k, vi, nil)
+				cs.collectHiding(ns, k, vi)
+			}
+		}
+	}
+	if s.partial() {
+		// a part only accounts for the clocks of the values it holds
+		if s.Clock > ns.clock {
+			ns.miss(ns.clock+1, s.Clock)
+			ns.advance(s.Clock)
+			changed = true
+		}
+		for _, vi := range s.Set {
+			if ns.recover(vi.C) {
+				changed = true
+			}
+		}
+		return changed
+	}
+	for _, r := range uncovered(1, s.Clock, s.Missed) {
+		if ns.recoverRange(r[0], r[1]) > 0 {
+			changed = true
+		}
+	}
+	if s.Clock > ns.clock {
+		changed = true
+		for _, r := range s.Missed {
+			if r[1] > ns.clock {
+				if r[0] <= ns.clock {
+					r[0] = ns.clock + 1
+				}
+				ns.miss(r[0], r[1])
+			}
+		}
+		ns.advance(s.Clock)
+	}
+	return changed
+}
+
+// mergeSnapshots keeps the newest snapshot of each node in cs.States,
+// joining adjacent parts of the same snapshot.
+// It is used when accumulating a batch.
+func (cs *clusterState) mergeSnapshots(states map[mesh.PeerName]*nodeSnapshot) {
+	if len(states) == 0 {
+		return
+	}
+	if cs.States == nil {
+		cs.States = map[mesh.PeerName]*nodeSnapshot{}
+	}
+	for p, s := range states {
+		if cur := cs.States[p]; cur == nil || s.Incarnation > cur.Incarnation ||
+			(s.Incarnation == cur.Incarnation && s.Clock > cur.Clock) {
+			cs.States[p] = s
+		} else if s.Incarnation == cur.Incarnation && s.Clock == cur.Clock {
+			if joined := cur.join(s); joined != nil {
+				cs.States[p] = joined
+			}
+		}
+	}
+}
+
+// join returns the part covering the keys of both s and o, or nil if
+// they are not adjacent parts of the same snapshot.
+func (s *nodeSnapshot) join(o *nodeSnapshot) *nodeSnapshot {
+	if !s.partial() || !o.partial() {
+		return nil
+	}
+	if o.To != "" && o.To == s.From {
+		s, o = o, s
+	}
+	if s.To == "" || s.To != o.From {
+		return nil
+	}
+	out := *s
+	out.To = o.To
+	out.Set = make(map[string]valueInstance, len(s.Set)+len(o.Set))
+	for k, vi := range s.Set {
+		out.Set[k] = vi
+	}
+	for k, vi := range o.Set {
+		out.Set[k] = vi
+	}
+	return &out
+}
@@ -0,0 +1,242 @@
+package gkv
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/weaveworks/mesh"
+)
+
+func TestStateMergeSnapshot(t *testing.T) {
+	logger := log.New(os.Stdout, "TEST ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+
+	for _, tc := range []struct {
+		description string
+		initial     clusterState
+		in          clusterState
+		want        clusterState
+	}{
+		{
+			"empty set, snapshot of new node",
+			//initial
+			clusterState{logger: logger, mtx: &sync.RWMutex{}, nodes: map[mesh.PeerName]*nodeState{}},
+			//in
+			clusterState{States: map[mesh.PeerName]*nodeSnapshot{
+				123: &nodeSnapshot{
+					Clock:  5,
+					Missed: [][2]int{{2, 2}},
+					Set: map[string]valueInstance{
+						"k1": valueInstance{C: 5, V: "v5"},
+						"k2": valueInstance{C: 3, V: "v3"},
+					},
+				}}},
+			//want
+			clusterState{
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 5, V: "v5"},
+							"k2": &valueInstance{C: 3, V: "v3"},
+						},
+						clock:  5,
+						missed: [][2]int{{2, 2}},
+					}}},
+		},
+		{
+			"existing set, snapshot ahead resolves missed clocks",
+			//initial
+			clusterState{
+				logger: logger,
+				mtx:    &sync.RWMutex{},
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 1, V: "v1"},
+							"k3": &valueInstance{C: 4, V: "v4"},
+						},
+						clock:  4,
+						missed: [][2]int{{2, 3}},
+					}}},
+			//in
+			clusterState{States: map[mesh.PeerName]*nodeSnapshot{
+				123: &nodeSnapshot{
+					Clock:  7,
+					Missed: [][2]int{{6, 6}},
+					Set: map[string]valueInstance{
+						"k1": valueInstance{C: 3, V: "v3"},
+						"k2": valueInstance{C: 7, V: "v7"},
+						"k3": valueInstance{C: 4, V: "v4"},
+					},
+				}}},
+			//want
+			clusterState{
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 3, V: "v3"},
+							"k2": &valueInstance{C: 7, V: "v7"},
+							"k3": &valueInstance{C: 4, V: "v4"},
+						},
+						clock:  7,
+						missed: [][2]int{{6, 6}},
+					}}},
+		},
+		{
+			"existing set, stale snapshot leaves newer values",
+			//initial
+			clusterState{
+				logger: logger,
+				mtx:    &sync.RWMutex{},
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 4, V: "v4"},
+						},
+						clock:  4,
+						missed: [][2]int{{3, 3}},
+					}}},
+			//in
+			clusterState{States: map[mesh.PeerName]*nodeSnapshot{
+				123: &nodeSnapshot{
+					Clock: 2,
+					Set: map[string]valueInstance{
+						"k1": valueInstance{C: 2, V: "v2"},
+					},
+				}}},
+			//want
+			clusterState{
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 4, V: "v4"},
+						},
+						clock:  4,
+						missed: [][2]int{{3, 3}},
+					}}},
+		},
+		{
+			"existing set, snapshot drops keys collected or expired since",
+			//initial
+			clusterState{
+				logger: logger,
+				mtx:    &sync.RWMutex{},
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 1, V: "v1"},
+							"k2": &valueInstance{C: 2, V: "v2"},
+							"k3": &valueInstance{C: 3, D: true},
+							"k4": &valueInstance{C: 6, V: "v6"},
+						},
+						clock: 6,
+					}}},
+			//in
+			clusterState{States: map[mesh.PeerName]*nodeSnapshot{
+				123: &nodeSnapshot{
+					Clock:  5,
+					Missed: [][2]int{{2, 2}},
+					Set: map[string]valueInstance{
+						"k5": valueInstance{C: 5, V: "v5"},
+					},
+				}}},
+			//want
+			clusterState{
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k2": &valueInstance{C: 2, V: "v2"},
+							"k4": &valueInstance{C: 6, V: "v6"},
+							"k5": &valueInstance{C: 5, V: "v5"},
+						},
+						clock: 6,
+					}}},
+		},
+		{
+			"existing set, part of a split snapshot only resolves clocks it holds",
+			//initial
+			clusterState{
+				logger: logger,
+				mtx:    &sync.RWMutex{},
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"a": &valueInstance{C: 1, V: "v1"},
+							"d": &valueInstance{C: 3, V: "v3"},
+						},
+						clock:  3,
+						missed: [][2]int{{2, 2}},
+					}}},
+			//in
+			clusterState{States: map[mesh.PeerName]*nodeSnapshot{
+				123: &nodeSnapshot{
+					Clock: 5,
+					To:    "c",
+					Set: map[string]valueInstance{
+						"a": valueInstance{C: 1, V: "v1"},
+						"b": valueInstance{C: 2, V: "v2"},
+					},
+				}}},
+			//want
+			clusterState{
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"a": &valueInstance{C: 1, V: "v1"},
+							"b": &valueInstance{C: 2, V: "v2"},
+							"d": &valueInstance{C: 3, V: "v3"},
+						},
+						clock:  5,
+						missed: [][2]int{{4, 5}},
+					}}},
+		},
+	} {
+		out := *tc.initial.Merge(&tc.in).(*clusterState)
+		if !csDeepEquals(tc.initial, tc.want) {
+			t.Errorf("Failed test for: %s (clusterState)", tc.description)
+			t.Errorf("Check clusterState failed:\nWanted: %s\nGot: %s", spew.Sdump(tc.want), spew.Sdump(tc.initial))
+		} else {
+			t.Logf("Passed test for: %s (clusterState)", tc.description)
+		}
+		if len(out.Deltas) != 0 {
+			t.Errorf("Check Merge() output failed for %s: unexpected deltas %s", tc.description, spew.Sdump(out.Deltas))
+		}
+	}
+}
+
+func TestStateCompleteState(t *testing.T) {
+	logger := log.New(os.Stdout, "TEST ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	cs := newClusterState(1, logger)
+	cs.Set("k1", "v1")
+	cs.Set("k1", "v2")
+	cs.Set("k2", "v1")
+
+	got := cs.completeState()
+	want := map[mesh.PeerName]*nodeSnapshot{
+		1: &nodeSnapshot{
+			Incarnation: cs.nodes[1].incarnation,
+			Clock:       3,
+			Set: map[string]valueInstance{
+				"k1": valueInstance{C: 2, V: "v2", T: cs.nodes[1].set["k1"].T},
+				"k2": valueInstance{C: 3, V: "v1", T: cs.nodes[1].set["k2"].T},
+			},
+		}}
+	if !reflect.DeepEqual(got.States, want) {
+		t.Errorf("Check completeState() failed:\nWanted: %s\nGot: %s", spew.Sdump(want), spew.Sdump(got.States))
+	}
+	if len(got.Deltas) != 0 || len(cs.Deltas) != 2 {
+		t.Errorf("Check completeState() failed: pending deltas should stay queued")
+	}
+}
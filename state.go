@@ -1,31 +1,97 @@
 package gkv
 
 import (
-	"encoding/json"
 	"errors"
 	"github.com/weaveworks/mesh"
 	"log"
+	"sort"
 	"sync"
+	"time"
 )
 
 type clusterState struct {
 	self   mesh.PeerName
 	nodes  map[mesh.PeerName]*nodeState
 	Deltas []delta
+	// States carries complete node states during full-state exchange
+	States map[mesh.PeerName]*nodeSnapshot `json:",omitempty"`
 	logger *log.Logger
 	mtx    *sync.RWMutex
+	// watchers are notified of every change applied to nodes
+	watchers []*watcher
+	// dir and wal persist our state, if enabled; applied and changed
+	// collect the deltas and node states a Merge applies, to be logged
+	dir     string
+	wal     *wal
+	applied []delta
+	changed map[mesh.PeerName]*nodeSnapshot
+	// codec encodes gossip, JSONCodec if zero
+	codec Codec
+	stats RepairStats
+	// queued indexes Deltas for coalescing; maxQueue, if set, bounds the
+	// optional deltas in it, those that may be dropped. Dropped deltas
+	// stay in place until the queue is compacted, and oldest is where to
+	// look for the next one to drop
+	queued   map[queueKey]int
+	maxQueue int
+	drop     DropPolicy
+	optional int
+	dropped  int
+	oldest   int
+	// maxFrame bounds the size of each encoded frame
+	maxFrame int
+	// ttls sets the hop count of new deltas; size is the number of mesh
+	// peers, if known, for adaptive hop counts
+	ttls TTLPolicy
+	size int
+	// members holds the other peers in the mesh, as last reported
+	members map[mesh.PeerName]bool
+	// reachable holds the peers we have a route to; direct holds deltas
+	// to unicast to one of them rather than broadcast
+	reachable map[mesh.PeerName]bool
+	direct    map[mesh.PeerName][]delta
+	// src is the peer a received batch came from, if known
+	src mesh.PeerName
+	// gone holds the incarnation of each node purged after departing
+	gone map[mesh.PeerName]int64
+	// hlc stamps our writes
+	hlc hlClock
 }
 
 type nodeState struct {
-	self   mesh.PeerName
-	set    map[string]*valueInstance
-	clock  int
-	missed map[int]bool
+	self mesh.PeerName
+	// incarnation changes each time the node starts afresh,
+	// and supersedes everything it wrote in earlier ones
+	incarnation int64
+	set         map[string]*valueInstance
+	// log indexes set by the clock each value was written at
+	log   map[int]string
+	clock int
+	// missed holds the runs of clocks that have not been received
+	missed [][2]int
+	// repair requests made for each run of missed clocks, by its first
+	retries map[int]*retry
+	// peers that have acknowledged the tombstone written at a clock
+	acks map[int]map[mesh.PeerName]bool
+	// the newest write of each set slot each peer has acknowledged
+	slotAcks map[string]map[mesh.PeerName]int
+	// departed is when the node left the mesh, zero while it is a member
+	departed time.Time
 }
 
 type valueInstance struct {
 	C int
 	V string
+	// D marks a tombstone left by a deletion
+	D bool `json:",omitempty"`
+	// E is when the value expires, in Unix nanoseconds; 0 never expires
+	E int64 `json:",omitempty"`
+	// T is when the value was written, for ordering the values different
+	// nodes hold for a key
+	T Timestamp `json:",omitempty"`
+	// O holds the writes of the key by other nodes that had been observed
+	// when the value was written, and that it therefore supersedes
+	O []writeTag `json:",omitempty"`
 }
 
 type delta struct {
@@ -34,212 +100,783 @@ type delta struct {
 	Ttl int
 	K   string
 	Vi  valueInstance
+	// I is the incarnation of P that Vi.C belongs to
+	I int64 `json:",omitempty"`
+	// Ack acknowledges that peer S has seen the tombstone or set slot P
+	// wrote at Vi.C;
+	// on a repair request, S is the peer asking
+	Ack bool          `json:",omitempty"`
+	S   mesh.PeerName `json:",omitempty"`
+	// Sup answers a repair request: the value P wrote at Vi.C has since
+	// been superseded, so there is nothing to repair
+	Sup bool `json:",omitempty"`
+	// To, if set, makes a repair request or superseded answer cover
+	// every clock from Vi.C to To
+	To int `json:",omitempty"`
+	// Gone announces that incarnation I of P has left the mesh, and its
+	// state should be purged
+	Gone bool `json:",omitempty"`
+	// Prior lists, in order, the earlier clocks at which P wrote K that
+	// Vi superseded while queued, so they were never sent
+	Prior []int `json:",omitempty"`
 }
 
+// Errors returned when looking up state.
+var (
+	ErrNodeNotFound = errors.New("node not found")
+	ErrKeyNotFound  = errors.New("key not found")
+	// ErrReservedKey is returned for writes of keys starting with a NUL
+	// byte, which hold the state of counters and sets.
+	ErrReservedKey = errors.New("key is reserved")
+)
+
 // state implements GossipData.
 var _ mesh.GossipData = &clusterState{}
 
 // Construct an empty state object, ready to receive updates.
 // This is suitable to use at program start.
 // Other peers will populate us with data.
-func newState(self mesh.PeerName) *clusterState {
+// Our incarnation is taken from the clock, so it increases across restarts.
+func newClusterState(self mesh.PeerName, logger *log.Logger) *clusterState {
 	return &clusterState{
-		self:  self,
-		nodes: map[mesh.PeerName]*nodeState{},
-		mtx:   &sync.RWMutex{},
+		self:   self,
+		nodes:  map[mesh.PeerName]*nodeState{self: newNodeState(self, time.Now().UnixNano())},
+		logger: logger,
+		mtx:    &sync.RWMutex{},
+		hlc:    hlClock{maxOffset: DefaultMaxClockOffset},
 	}
 }
 
-func newNodeState(self mesh.PeerName) *nodeState {
+func newNodeState(self mesh.PeerName, incarnation int64) *nodeState {
 	return &nodeState{
-		self:   self,
-		set:    map[string]*valueInstance{},
-		clock:  0,
-		missed: map[int]bool{},
+		self:        self,
+		incarnation: incarnation,
+		set:         map[string]*valueInstance{},
+		log:         map[int]string{},
+		clock:       0,
+		acks:        map[int]map[mesh.PeerName]bool{},
+	}
+}
+
+// index returns the clock-to-key log of ns, building it if need be.
+func (ns *nodeState) index() map[int]string {
+	if ns.log == nil {
+		ns.log = make(map[int]string, len(ns.set))
+		for k, vi := range ns.set {
+			ns.log[vi.C] = k
+		}
+	}
+	return ns.log
+}
+
+// put sets key to vi, keeping the log in step.
+func (ns *nodeState) put(key string, vi *valueInstance) {
+	idx := ns.index()
+	if old := ns.set[key]; old != nil && idx[old.C] == key {
+		delete(idx, old.C)
 	}
+	if old := ns.set[key]; old != nil && old.D && old.C != vi.C {
+		// nobody waits on a tombstone that is gone
+		delete(ns.acks, old.C)
+	}
+	ns.set[key] = vi
+	idx[vi.C] = key
+}
+
+// awaitsAck reports whether an ack of the tombstone ns wrote for key at
+// clock c may still be needed: we hold that tombstone, or have yet to
+// receive clock c. Late acks of a tombstone since collected or replaced
+// are not kept.
+func (ns *nodeState) awaitsAck(key string, c int) bool {
+	if vi := ns.set[key]; vi != nil && vi.D && vi.C == c {
+		return true
+	}
+	return c > ns.clock || ns.missing(c)
+}
+
+// remove deletes key, keeping the log in step.
+func (ns *nodeState) remove(key string) {
+	idx := ns.index()
+	if old := ns.set[key]; old != nil && idx[old.C] == key {
+		delete(idx, old.C)
+	}
+	if old := ns.set[key]; old != nil && old.D {
+		delete(ns.acks, old.C)
+	}
+	delete(ns.set, key)
+}
+
+// at returns the key whose current value was written at clock c, if any.
+func (ns *nodeState) at(c int) (string, *valueInstance) {
+	k, ok := ns.index()[c]
+	if !ok {
+		return "", nil
+	}
+	return k, ns.set[k]
 }
 
+// copyDeltas returns a batch holding the pending deltas.
+// A batch has no nodes, so merging into it just accumulates deltas;
+// this is what mesh does with data queued up for a connection.
 func (cs *clusterState) copyDeltas() *clusterState {
 	return &clusterState{
-		Deltas: cs.Deltas,
+		Deltas:   cs.Deltas[:len(cs.Deltas):len(cs.Deltas)],
+		logger:   cs.logger,
+		mtx:      &sync.RWMutex{},
+		codec:    cs.codec,
+		maxFrame: cs.maxFrame,
 	}
 }
 
+// takeDeltas returns the pending deltas as a batch and clears them,
+// or nil if there is nothing to send.
+func (cs *clusterState) takeDeltas() *clusterState {
+	// get write lock
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.compactQueue()
+	if len(cs.Deltas) == 0 {
+		return nil
+	}
+	out := cs.copyDeltas()
+	cs.clearQueue()
+	return out
+}
+
 func (vi *valueInstance) copy() *valueInstance {
 	return &valueInstance{
 		C: vi.C,
 		V: vi.V,
+		D: vi.D,
+		E: vi.E,
+		T: vi.T,
+		O: append([]writeTag(nil), vi.O...),
 	}
 }
 
+// expired reports whether vi has expired at now.
+func (vi *valueInstance) expired(now time.Time) bool {
+	return vi.E != 0 && vi.E <= now.UnixNano()
+}
+
+// now returns the time values expire by. Only our own wall clock counts,
+// so a peer whose clock runs fast can't expire values early.
+func (cs *clusterState) now() time.Time {
+	return time.Now()
+}
+
 func (cs *clusterState) Set(key, value string) {
-	// get write lock
-	cs.mtx.Lock()
-	defer cs.mtx.Unlock()
+	cs.SetWithExpiry(key, value, 0)
+}
+
+// SetWithExpiry sets key to value, which every peer will treat as deleted
+// once d has elapsed. A d of 0 means the value never expires. Reserved
+// keys are left untouched.
+func (cs *clusterState) SetWithExpiry(key, value string, d time.Duration) {
+	if internal(key) {
+		cs.logger.Printf("Refused write of reserved key: %q", key)
+		return
+	}
+	cs.update(func() error {
+		cs.write(key, value, d)
+		return nil
+	})
+}
+
+// write sets key to value on our own node and queues the delta.
+// Must be called with the write lock held.
+func (cs *clusterState) write(key, value string, d time.Duration) {
+	t := cs.hlc.now(time.Now())
+	var e int64
+	if d > 0 {
+		e = t.Time().Add(d).UnixNano()
+	}
 	// set key
-	cs.nodes[cs.self].set[key] = &valueInstance{
+	old := cs.nodes[cs.self].set[key]
+	cs.nodes[cs.self].put(key, &valueInstance{
 		C: cs.nodes[cs.self].clock + 1,
 		V: value,
-	}
+		E: e,
+		T: t,
+		O: cs.observed(key),
+	})
+	cs.notify(EventSet, cs.self, key, old, cs.nodes[cs.self].set[key])
+	cs.collectHiding(cs.nodes[cs.self], key, old)
 	// create delta
-	cs.Deltas = append(cs.Deltas, delta{
-		Fix: true,
+	up := delta{
 		P:   cs.self,
-		Ttl: 3,
+		Ttl: cs.ttl(ttlUpdate),
+		K:   key,
 		Vi:  *cs.nodes[cs.self].set[key],
-	})
+		I:   cs.nodes[cs.self].incarnation,
+	}
+	cs.record(&clusterState{Deltas: []delta{up}})
+	cs.enqueue(up)
 	// update clock
-	cs.nodes[cs.self].clock++
+	cs.nodes[cs.self].advance(cs.nodes[cs.self].clock + 1)
+}
+
+// Delete removes key, leaving a tombstone that is gossiped like any other
+// update and collected once every known peer has acknowledged it.
+func (cs *clusterState) Delete(key string) error {
+	if internal(key) {
+		return ErrReservedKey
+	}
+	return cs.update(func() error {
+		// check key exists
+		ns := cs.nodes[cs.self]
+		old := ns.set[key]
+		if old == nil || old.D || old.expired(cs.now()) {
+			return ErrKeyNotFound
+		}
+		// set tombstone
+		ns.put(key, &valueInstance{
+			C: ns.clock + 1,
+			D: true,
+			T: cs.hlc.now(time.Now()),
+			O: cs.observed(key),
+		})
+		cs.notify(EventDelete, cs.self, key, old, ns.set[key])
+		// create delta
+		up := delta{
+			P:   cs.self,
+			Ttl: cs.ttl(ttlUpdate),
+			K:   key,
+			Vi:  *ns.set[key],
+			I:   ns.incarnation,
+		}
+		cs.record(&clusterState{Deltas: []delta{up}})
+		cs.enqueue(up)
+		// update clock
+		ns.advance(ns.clock + 1)
+		cs.collectTombstone(ns, key)
+		return nil
+	})
 }
 
 func (cs *clusterState) Get(node mesh.PeerName, key string) (string, error) {
+	if internal(key) {
+		return "", ErrKeyNotFound
+	}
 	// get read lock
 	cs.mtx.RLock()
 	defer cs.mtx.RUnlock()
 	// check node exists
 	ns := cs.nodes[node]
 	if ns == nil {
-		return "", errors.New("node not found")
+		return "", ErrNodeNotFound
 	}
 	// check key exists
 	vi := ns.set[key]
-	if vi == nil {
-		return "", errors.New("key not found")
+	if vi == nil || vi.D || vi.expired(cs.now()) {
+		return "", ErrKeyNotFound
 	} else {
 		return vi.V, nil
 	}
 }
 
-// Encode serializes the changes that have been made to this state
-func (cs *clusterState) Encode() [][]byte {
+// Nodes returns the peers we hold state for.
+func (cs *clusterState) Nodes() []mesh.PeerName {
+	// get read lock
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+	nodes := make([]mesh.PeerName, 0, len(cs.nodes))
+	for p := range cs.nodes {
+		nodes = append(nodes, p)
+	}
+	return nodes
+}
+
+// Keys returns the live keys and values owned by node.
+func (cs *clusterState) Keys(node mesh.PeerName) (map[string]string, error) {
+	// get read lock
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+	// check node exists
+	ns := cs.nodes[node]
+	if ns == nil {
+		return nil, ErrNodeNotFound
+	}
+	now := cs.now()
+	kvs := map[string]string{}
+	for k, vi := range ns.set {
+		if !vi.D && !vi.expired(now) && !internal(k) {
+			kvs[k] = vi.V
+		}
+	}
+	return kvs, nil
+}
+
+// expire drops every value that has expired at now, from all nodes.
+// Each peer enforces expiry itself, so nothing is gossiped.
+func (cs *clusterState) expire(now time.Time) {
 	// get write lock
 	cs.mtx.Lock()
 	defer cs.mtx.Unlock()
-	// copy and clear deltas
+	for p, ns := range cs.nodes {
+		for k, vi := range ns.set {
+			if vi.expired(now) {
+				cs.logger.Printf("Expired key: %v->%v->%v", p, k, vi.C)
+				ns.remove(k)
+				cs.notify(EventExpire, p, k, vi, nil)
+			}
+		}
+	}
+}
+
+// Encode serializes the changes that have been made to this state.
+// It leaves them in place, as mesh may encode the same batch once for
+// each connection it is sent on.
+func (cs *clusterState) Encode() [][]byte {
+	// get read lock
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
 	out := cs.copyDeltas()
-	cs.Deltas = nil
+	out.Deltas = cs.liveDeltas()
+	out.States = cs.States
 	// encode
 	cs.logger.Printf("Encoding %v deltas", len(out.Deltas))
-	b, err := json.Marshal(out)
-	if err != nil {
-		cs.logger.Printf("Error encoding clusterState deltas: %v", err)
+	codec := cs.codec
+	if codec == 0 {
+		codec = JSONCodec
 	}
-	return [][]byte{b}
+	limit := cs.maxFrame
+	if limit <= 0 {
+		limit = DefaultMaxFrameSize
+	}
+	return cs.frames(codec, out, limit)
 }
 
 // Merge merges the deltas from the other clusterState into this one.
 // If deltas are determined to be missing, then Fix requests are sent out
 func (cs *clusterState) Merge(other mesh.GossipData) (complete mesh.GossipData) {
-	// get write lock
-	cs.mtx.Lock()
-	defer cs.mtx.Unlock()
+	cs.update(func() error {
+		// a batch only accumulates deltas and states
+		if cs.nodes == nil {
+			for _, d := range other.(*clusterState).Deltas {
+				cs.enqueue(d)
+			}
+			cs.mergeSnapshots(other.(*clusterState).States)
+			complete = cs
+			return nil
+		}
+		cs.merge(other.(*clusterState))
+		// only what was applied is logged
+		if len(cs.applied) > 0 || len(cs.changed) > 0 {
+			cs.record(&clusterState{Deltas: cs.applied, States: cs.changed})
+			cs.applied, cs.changed = nil, nil
+		}
+		cs.compactQueue()
+		complete = cs.copyDeltas()
+		return nil
+	})
+	return complete
+}
+
+// merge applies the states and deltas of other.
+// Must be called with the write lock held.
+func (cs *clusterState) merge(other *clusterState) {
+	// bring whole nodes up to date first
+	for p, s := range other.States {
+		if cs.mergeSnapshot(p, s) && cs.wal != nil {
+			// logged whole: replayed as deltas, its values would look
+			// like clock jumps
+			if cs.changed == nil {
+				cs.changed = map[mesh.PeerName]*nodeSnapshot{}
+			}
+			cs.changed[p] = s
+		}
+	}
+	// the values states applied are logged with them
+	cs.applied = nil
 	// loop through all recieved deltas
-	n := len(other.(*clusterState).Deltas)
-	for i, d := range other.(*clusterState).Deltas {
-		if !d.Fix {
+	n := len(other.Deltas)
+	for i, d := range other.Deltas {
+		if !cs.current(d) {
+			cs.logger.Printf("%v/%v deltas: earlier incarnation %v of node %v", i+1, n, d.I, d.P)
+			continue
+		}
+		if d.Gone {
+			// node has left the mesh
+			if d.P != cs.self && !cs.reachable[d.P] {
+				cs.logger.Printf("%v/%v deltas: node gone: %v", i+1, n, d.P)
+				cs.purge(d.P, d.I)
+			}
+			d.Ttl = d.Ttl - 1
+			if d.Ttl > 0 {
+				cs.enqueue(d)
+			}
+		} else if d.Ack {
+			// tombstone or set slot acknowledgement
+			if ns := cs.nodes[d.P]; ns != nil && d.S != cs.self && isSetSlot(d.K) {
+				ns.ackSlot(d.K, d.S, d.Vi.C)
+				cs.pruneSet(d.K)
+			} else if ns != nil && d.S != cs.self && ns.awaitsAck(d.K, d.Vi.C) {
+				cs.logger.Printf("%v/%v deltas: tombstone ack from %v: %v->%v->%v", i+1, n, d.S, d.P, d.K, d.Vi.C)
+				if ns.acks == nil {
+					ns.acks = map[int]map[mesh.PeerName]bool{}
+				}
+				if ns.acks[d.Vi.C] == nil {
+					ns.acks[d.Vi.C] = map[mesh.PeerName]bool{}
+				}
+				ns.acks[d.Vi.C][d.S] = true
+				cs.collectTombstone(ns, d.K)
+			}
+			d.Ttl = d.Ttl - 1
+			if d.Ttl > 0 {
+				cs.enqueue(d)
+			}
+		} else if d.Sup {
+			// repair request can't be satisfied
+			if ns := cs.nodes[d.P]; ns != nil {
+				if ns.recoverRange(d.Vi.C, d.last()) > 0 {
+					cs.logger.Printf("%v/%v deltas: superseded clocks: %v->%v-%v", i+1, n, d.P, d.Vi.C, d.last())
+				}
+			}
+			d.Ttl = d.Ttl - 1
+			if d.Ttl > 0 {
+				cs.enqueue(d)
+			}
+		} else if !d.Fix {
 			// is update
 			if cs.nodes[d.P] == nil {
 				// node did not exist
-				cs.nodes[d.P] = newNodeState(d.P)
+				cs.nodes[d.P] = newNodeState(d.P, d.I)
 				// update
 				cs.logger.Printf("%v/%v deltas: new node with key: %v->%v->%v:%v", i+1, n, d.P, d.K, d.Vi.C, d.Vi.V)
-				cs.nodes[d.P].set[d.K] = d.Vi.copy()
-				cs.nodes[d.P].clock = d.Vi.C
+				cs.apply(d, false)
+				cs.nodes[d.P].advance(d.Vi.C)
 				d.Ttl = d.Ttl - 1
 				if d.Ttl > 0 {
-					cs.Deltas = append(cs.Deltas, d)
+					cs.enqueue(d)
 				}
+				cs.ackWrite(d)
 			} else if d.Vi.C > cs.nodes[d.P].clock {
 				// is new`update, check if clock has skipped
-				for j := cs.nodes[d.P].clock + 1; j < d.Vi.C; j++ {
-					cs.nodes[d.P].missed[j] = true
-					cs.logger.Printf("Missed delta clock %v for node %v", j, d.P)
-					f := delta{
-						Fix: true,
-						P:   d.P,
-						Ttl: 3,
-						Vi:  valueInstance{C: j},
-					}
-					cs.Deltas = append(cs.Deltas, f)
+				// apart from the writes it superseded
+				for _, r := range uncovered(cs.nodes[d.P].clock+1, d.Vi.C-1, runs(d.Prior)) {
+					cs.nodes[d.P].miss(r[0], r[1])
+					cs.logger.Printf("Missed delta clocks %v-%v for node %v", r[0], r[1], d.P)
+					// request the whole gap at once, from the origin if we can
+					cs.sendTo(d.P, cs.repairRequest(d.P, d.I, r[0], r[1]))
 				}
 				// and update
 				cs.logger.Printf("%v/%v deltas: update key: %v->%v->%v:%v", i+1, n, d.P, d.K, d.Vi.C, d.Vi.V)
-				cs.nodes[d.P].set[d.K] = d.Vi.copy()
-				cs.nodes[d.P].clock = d.Vi.C
+				cs.apply(d, false)
+				cs.nodes[d.P].advance(d.Vi.C)
 				d.Ttl = d.Ttl - 1
 				if d.Ttl > 0 {
-					cs.Deltas = append(cs.Deltas, d)
+					cs.enqueue(d)
 				}
+				cs.ackWrite(d)
 			} else {
 				// old update
-				if cs.nodes[d.P].missed[d.Vi.C] {
+				if cs.nodes[d.P].missing(d.Vi.C) {
 					// missing update!
 					if cs.nodes[d.P].set[d.K] == nil || d.Vi.C > cs.nodes[d.P].set[d.K].C {
 						// key doesn't exist or has a lower clock
 						cs.logger.Printf("%v/%v deltas: repair key: %v->%v->%v:%v", i+1, n, d.P, d.K, d.Vi.C, d.Vi.V)
-						cs.nodes[d.P].set[d.K] = d.Vi.copy()
+						cs.apply(d, true)
 						d.Ttl = d.Ttl - 1
 						if d.Ttl > 0 {
-							cs.Deltas = append(cs.Deltas, d)
+							cs.enqueue(d)
 						}
+						cs.ackWrite(d)
 					} else {
 						// stale repair
 						cs.logger.Printf("%v/%v deltas: stale repair: %v->%v->%v:%v", i+1, n, d.P, d.K, d.Vi.C, d.Vi.V)
 						d.Ttl = d.Ttl - 1
 						if d.Ttl > 0 {
-							cs.Deltas = append(cs.Deltas, d)
+							cs.enqueue(d)
 						}
 					}
-					cs.nodes[d.P].missed[d.Vi.C] = false
+					cs.nodes[d.P].recover(d.Vi.C)
 				} else {
 					// repair not needed
 					cs.logger.Printf("%v/%v deltas: already consistent: %v->%v->%v:%v", i+1, n, d.P, d.K, d.Vi.C, d.Vi.V)
 					d.Ttl = d.Ttl - 1
 					if d.Ttl > 0 {
-						cs.Deltas = append(cs.Deltas, d)
+						cs.enqueue(d)
 					}
 				}
 			}
+			// writes it superseded won't be sent on their own
+			for _, c := range d.Prior {
+				if cs.nodes[d.P].recover(c) {
+					cs.logger.Printf("%v/%v deltas: superseded clock: %v->%v", i+1, n, d.P, c)
+				}
+			}
 		} else {
 			// repair request!
+			if d.S == mesh.UnknownPeerName {
+				d.S = other.src
+			}
 			if cs.nodes[d.P] == nil {
 				// node did not exist, pass on request
 				cs.logger.Printf("%v/%v deltas: repair request for unknown node %v", i+1, n, d.P)
 				d.Ttl = d.Ttl - 1
 				if d.Ttl > 0 {
-					cs.Deltas = append(cs.Deltas, d)
+					cs.enqueue(d)
 				}
 			} else {
-				// see if we have key with said clock
-				found := false
-				for k, vi := range cs.nodes[d.P].set {
-					if vi.C == d.Vi.C {
-						// found key!
-						cs.logger.Printf("%v/%v deltas: repair request fulfilled: %v->%v->%v:%v", i+1, n, d.P, k, vi.C, vi.V)
-						r := delta{
-							P:   d.P,
-							Ttl: 3,
-							K:   k,
-							Vi: valueInstance{
-								C: vi.C,
-								V: vi.V,
-							},
-						}
-						// send out repair
-						cs.Deltas = append(cs.Deltas, r)
-						found = true
-						break
-					}
-				}
-				if !found {
-					cs.logger.Printf("%v/%v deltas: repair request for unknown clock %v", i+1, n, d.Vi.C)
-					d.Ttl = d.Ttl - 1
-					if d.Ttl > 0 {
-						cs.Deltas = append(cs.Deltas, d)
-					}
-				}
+				cs.answerRepair(cs.nodes[d.P], d)
+			}
+		}
+	}
+}
+
+// last returns the final clock covered by d.
+func (d delta) last() int {
+	if d.To > d.Vi.C {
+		return d.To
+	}
+	return d.Vi.C
+}
+
+// repairRequest asks for the values node p wrote at clocks from to to.
+func (cs *clusterState) repairRequest(p mesh.PeerName, incarnation int64, from, to int) delta {
+	f := delta{
+		Fix: true,
+		P:   p,
+		S:   cs.self,
+		Ttl: cs.ttl(ttlRequest),
+		Vi:  valueInstance{C: from},
+		I:   incarnation,
+	}
+	if to > from {
+		f.To = to
+	}
+	return f
+}
+
+// answerRepair responds to the repair request d with the current value
+// for every clock it covers that we hold, and a superseded answer for the
+// clocks whose values have since been overwritten. Clocks we know nothing
+// about are passed on. Answers go straight back to the peer asking, if it
+// is reachable. Must be called with the write lock held.
+func (cs *clusterState) answerRepair(ns *nodeState, d delta) {
+	// only clocks up to our own can be answered; the rest are unknown
+	from, to := d.Vi.C, d.last()
+	top := to
+	if top > ns.clock {
+		top = ns.clock
+	}
+	var held []int
+	if idx := ns.index(); top-from < len(idx) {
+		for c := from; c <= top; c++ {
+			if _, ok := idx[c]; ok {
+				held = append(held, c)
+			}
+		}
+	} else {
+		for c := range idx {
+			if c >= from && c <= top {
+				held = append(held, c)
+			}
+		}
+		sort.Ints(held)
+	}
+	for _, c := range held {
+		// found key!
+		k, vi := ns.at(c)
+		cs.logger.Printf("Repair request fulfilled: %v->%v->%v:%v", d.P, k, vi.C, vi.V)
+		cs.sendTo(d.S, delta{
+			P:   d.P,
+			Ttl: cs.ttl(ttlRepair),
+			K:   k,
+			Vi:  *vi,
+			I:   d.I,
+		})
+	}
+	// runs of superseded and unknown clocks: those we saw whose values
+	// have since been overwritten, and those we missed or never reached
+	var sup, unknown [][2]int
+	for _, r := range uncovered(from, top, ns.missed) {
+		sup = append(sup, uncovered(r[0], r[1], runs(held))...)
+	}
+	for _, r := range ns.missed {
+		if r[1] >= from && r[0] <= top {
+			if r[0] < from {
+				r[0] = from
+			}
+			if r[1] > top {
+				r[1] = top
+			}
+			unknown = append(unknown, r)
+		}
+	}
+	if from := top + 1; from <= to {
+		if from < d.Vi.C {
+			from = d.Vi.C
+		}
+		unknown = append(unknown, [2]int{from, to})
+	}
+	for _, r := range sup {
+		cs.logger.Printf("Repair request for superseded clocks: %v->%v-%v", d.P, r[0], r[1])
+		s := delta{
+			Sup: true,
+			P:   d.P,
+			Ttl: cs.ttl(ttlRepair),
+			Vi:  valueInstance{C: r[0]},
+			I:   d.I,
+		}
+		if r[1] > r[0] {
+			s.To = r[1]
+		}
+		cs.sendTo(d.S, s)
+	}
+	if d.Ttl-1 <= 0 {
+		return
+	}
+	for _, r := range unknown {
+		cs.logger.Printf("Repair request for unknown clocks: %v->%v-%v", d.P, r[0], r[1])
+		f := cs.repairRequest(d.P, d.I, r[0], r[1])
+		f.S = d.S
+		f.Ttl = d.Ttl - 1
+		cs.enqueue(f)
+	}
+}
+
+// current reports whether d belongs to the incarnation of its node that
+// we know of. If d comes from a newer incarnation the node has restarted,
+// so everything we knew of it, including missed clocks, is forgotten.
+// Deltas from earlier incarnations, or from a purged one, should be
+// dropped.
+func (cs *clusterState) current(d delta) bool {
+	if i, ok := cs.gone[d.P]; ok && d.I <= i {
+		return false
+	}
+	ns := cs.nodes[d.P]
+	if ns == nil || d.I == ns.incarnation {
+		return true
+	}
+	if d.P == cs.self {
+		cs.outlive(d.I)
+		return false
+	}
+	if d.I < ns.incarnation {
+		return false
+	}
+	cs.logger.Printf("Node %v restarted: incarnation %v -> %v", d.P, ns.incarnation, d.I)
+	cs.keepCounters(ns)
+	cs.nodes[d.P] = newNodeState(d.P, d.I)
+	return true
+}
+
+// outlive moves our incarnation past i, if a peer knows of that life of
+// ours and it is later than this one. The wall clock may have stepped
+// back since it began, and peers would drop everything we write until
+// our incarnation overtakes it. Must be called with the write lock held.
+func (cs *clusterState) outlive(i int64) {
+	ns := cs.nodes[cs.self]
+	if i <= ns.incarnation {
+		return
+	}
+	cs.logger.Printf("Peers know incarnation %v of this node: incarnation %v -> %v", i, ns.incarnation, i+1)
+	old := ns.incarnation
+	ns.incarnation = i + 1
+	// what we have yet to send belongs to this life too; the rest of our
+	// state reaches peers with our next complete state
+	for j, d := range cs.Deltas {
+		if d.P == cs.self && d.I == old {
+			cs.Deltas[j].I = ns.incarnation
+		}
+	}
+	for _, deltas := range cs.direct {
+		for j, d := range deltas {
+			if d.P == cs.self && d.I == old {
+				deltas[j].I = ns.incarnation
 			}
 		}
 	}
-	return cs.copyDeltas()
+}
+
+// apply writes the value carried by d into its node's set and notifies
+// watchers of the change.
+func (cs *clusterState) apply(d delta, repair bool) {
+	if !cs.hlc.update(d.Vi.T, time.Now()) {
+		cs.logger.Printf("Clock of node %v is ahead: %v->%v stamped %v", d.P, d.K, d.Vi.C, d.Vi.T.Time())
+	}
+	if cs.wal != nil {
+		cs.applied = append(cs.applied, d)
+	}
+	ns := cs.nodes[d.P]
+	old := ns.set[d.K]
+	ns.put(d.K, d.Vi.copy())
+	t := EventSet
+	if d.Vi.D {
+		t = EventDelete
+	} else if repair {
+		t = EventRepair
+	}
+	cs.notify(t, d.P, d.K, old, ns.set[d.K])
+	if d.P != cs.self {
+		cs.pruneSet(d.K)
+	}
+	cs.collectHiding(ns, d.K, old)
+}
+
+// ackWrite tells the cluster we have applied the tombstone or set slot in
+// d. A tombstone is then collected if nobody else is waiting on it.
+func (cs *clusterState) ackWrite(d delta) {
+	if !d.Vi.D && !isSetSlot(d.K) {
+		return
+	}
+	cs.enqueue(delta{
+		Ack: true,
+		P:   d.P,
+		S:   cs.self,
+		Ttl: cs.ttl(ttlAck),
+		K:   d.K,
+		Vi:  valueInstance{C: d.Vi.C},
+		I:   d.I,
+	})
+	if d.Vi.D {
+		cs.collectTombstone(cs.nodes[d.P], d.K)
+	}
+}
+
+// collectTombstones collects every tombstone that is no longer waited on.
+// Must be called with the write lock held.
+func (cs *clusterState) collectTombstones() {
+	for _, ns := range cs.nodes {
+		for k, vi := range ns.set {
+			if vi.D {
+				cs.collectTombstone(ns, k)
+			}
+		}
+	}
+}
+
+// ackedByAll reports whether acked holds for every member of the mesh and
+// every peer we hold state for, other than ourselves, owner and those
+// departed. Peers that only read are members too: they may have missed
+// what owner wrote.
+// Must be called with the read lock held.
+func (cs *clusterState) ackedByAll(owner mesh.PeerName, acked func(mesh.PeerName) bool) bool {
+	for p := range cs.members {
+		if p != cs.self && p != owner && !acked(p) {
+			return false
+		}
+	}
+	for p, other := range cs.nodes {
+		if p != cs.self && p != owner && other.departed.IsZero() && !acked(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// collectTombstone removes the tombstone for key from ns once every peer
+// has acknowledged it, and it no longer hides a value another node holds.
+func (cs *clusterState) collectTombstone(ns *nodeState, key string) {
+	vi := ns.set[key]
+	if vi == nil || !vi.D || cs.hides(key, vi) {
+		return
+	}
+	if !cs.ackedByAll(ns.self, func(p mesh.PeerName) bool { return ns.acks[vi.C][p] }) {
+		return
+	}
+	cs.logger.Printf("Collected tombstone: %v->%v->%v", ns.self, key, vi.C)
+	ns.remove(key)
 }
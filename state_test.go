@@ -1,11 +1,14 @@
 package gkv
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/weaveworks/mesh"
@@ -20,8 +23,9 @@ func csDeepEquals(a, b clusterState) bool {
 			return false
 		}
 		equal = equal && reflect.DeepEqual(ans.self, bns.self)
+		equal = equal && reflect.DeepEqual(ans.incarnation, bns.incarnation)
 		equal = equal && reflect.DeepEqual(ans.clock, bns.clock)
-		equal = equal && reflect.DeepEqual(ans.missed, bns.missed)
+		equal = equal && reflect.DeepEqual(ans.gaps(), bns.gaps())
 		for k, avi := range ans.set {
 			bvi := bns.set[k]
 			if bvi == nil {
@@ -29,6 +33,7 @@ func csDeepEquals(a, b clusterState) bool {
 			}
 			equal = equal && reflect.DeepEqual(avi.C, bvi.C)
 			equal = equal && reflect.DeepEqual(avi.V, bvi.V)
+			equal = equal && reflect.DeepEqual(avi.D, bvi.D)
 		}
 	}
 	for p, bns := range b.nodes {
@@ -37,8 +42,9 @@ func csDeepEquals(a, b clusterState) bool {
 			return false
 		}
 		equal = equal && reflect.DeepEqual(ans.self, bns.self)
+		equal = equal && reflect.DeepEqual(ans.incarnation, bns.incarnation)
 		equal = equal && reflect.DeepEqual(ans.clock, bns.clock)
-		equal = equal && reflect.DeepEqual(ans.missed, bns.missed)
+		equal = equal && reflect.DeepEqual(ans.gaps(), bns.gaps())
 		for k, bvi := range bns.set {
 			avi := ans.set[k]
 			if avi == nil {
@@ -46,6 +52,7 @@ func csDeepEquals(a, b clusterState) bool {
 			}
 			equal = equal && reflect.DeepEqual(avi.C, bvi.C)
 			equal = equal && reflect.DeepEqual(avi.V, bvi.V)
+			equal = equal && reflect.DeepEqual(avi.D, bvi.D)
 		}
 	}
 	return equal
@@ -77,21 +84,20 @@ func TestStateMergeReceived(t *testing.T) {
 			//initial
 			clusterState{logger: logger, mtx: &sync.RWMutex{}, nodes: map[mesh.PeerName]*nodeState{}},
 			//in
-			clusterState{Deltas: []delta{delta{false, 123, 3, "k1", valueInstance{1, "v1"}}}},
+			clusterState{Deltas: []delta{delta{Fix: false, P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 1, V: "v1"}}}},
 			//out
-			clusterState{Deltas: []delta{delta{false, 123, 2, "k1", valueInstance{1, "v1"}}}},
+			clusterState{Deltas: []delta{delta{Fix: false, P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 1, V: "v1"}}}},
 			//want
 			clusterState{
 				nodes: map[mesh.PeerName]*nodeState{
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{1, "v1"},
+							"k1": &valueInstance{C: 1, V: "v1"},
 						},
-						clock:  1,
-						missed: map[int]bool{},
+						clock: 1,
 					}},
-				Deltas: []delta{delta{false, 123, 2, "k1", valueInstance{1, "v1"}}}},
+				Deltas: []delta{delta{Fix: false, P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 1, V: "v1"}}}},
 		},
 		{
 			"exisiting set, valid update delta",
@@ -103,27 +109,25 @@ func TestStateMergeReceived(t *testing.T) {
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{1, "v1"},
+							"k1": &valueInstance{C: 1, V: "v1"},
 						},
-						clock:  1,
-						missed: map[int]bool{},
+						clock: 1,
 					}}},
 			//in
-			clusterState{Deltas: []delta{delta{false, 123, 3, "k1", valueInstance{2, "v2"}}}},
+			clusterState{Deltas: []delta{delta{Fix: false, P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 2, V: "v2"}}}},
 			//out
-			clusterState{Deltas: []delta{delta{false, 123, 2, "k1", valueInstance{2, "v2"}}}},
+			clusterState{Deltas: []delta{delta{Fix: false, P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 2, V: "v2"}}}},
 			//want
 			clusterState{
 				nodes: map[mesh.PeerName]*nodeState{
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{2, "v2"},
+							"k1": &valueInstance{C: 2, V: "v2"},
 						},
-						clock:  2,
-						missed: map[int]bool{},
+						clock: 2,
 					}},
-				Deltas: []delta{delta{false, 123, 2, "k1", valueInstance{2, "v2"}}}},
+				Deltas: []delta{delta{Fix: false, P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 2, V: "v2"}}}},
 		},
 		{
 			"existing set, valid new key delta",
@@ -135,28 +139,26 @@ func TestStateMergeReceived(t *testing.T) {
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{1, "v1"},
+							"k1": &valueInstance{C: 1, V: "v1"},
 						},
-						clock:  1,
-						missed: map[int]bool{},
+						clock: 1,
 					}}},
 			//in
-			clusterState{Deltas: []delta{delta{false, 123, 3, "k2", valueInstance{2, "v1"}}}},
+			clusterState{Deltas: []delta{delta{Fix: false, P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 2, V: "v1"}}}},
 			//out
-			clusterState{Deltas: []delta{delta{false, 123, 2, "k2", valueInstance{2, "v1"}}}},
+			clusterState{Deltas: []delta{delta{Fix: false, P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 2, V: "v1"}}}},
 			//want
 			clusterState{
 				nodes: map[mesh.PeerName]*nodeState{
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{1, "v1"},
-							"k2": &valueInstance{2, "v1"},
+							"k1": &valueInstance{C: 1, V: "v1"},
+							"k2": &valueInstance{C: 2, V: "v1"},
 						},
-						clock:  2,
-						missed: map[int]bool{},
+						clock: 2,
 					}},
-				Deltas: []delta{delta{false, 123, 2, "k2", valueInstance{2, "v1"}}}},
+				Deltas: []delta{delta{Fix: false, P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 2, V: "v1"}}}},
 		},
 		{
 			"existing set, invalid (lower clock) update delta",
@@ -168,27 +170,25 @@ func TestStateMergeReceived(t *testing.T) {
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{2, "v2"},
+							"k1": &valueInstance{C: 2, V: "v2"},
 						},
-						clock:  2,
-						missed: map[int]bool{},
+						clock: 2,
 					}}},
 			//in
-			clusterState{Deltas: []delta{delta{false, 123, 3, "k2", valueInstance{1, "v1"}}}},
+			clusterState{Deltas: []delta{delta{Fix: false, P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 1, V: "v1"}}}},
 			//out
-			clusterState{Deltas: []delta{delta{false, 123, 2, "k2", valueInstance{1, "v1"}}}},
+			clusterState{Deltas: []delta{delta{Fix: false, P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 1, V: "v1"}}}},
 			//want
 			clusterState{
 				nodes: map[mesh.PeerName]*nodeState{
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{2, "v2"},
+							"k1": &valueInstance{C: 2, V: "v2"},
 						},
-						clock:  2,
-						missed: map[int]bool{},
+						clock: 2,
 					}},
-				Deltas: []delta{delta{false, 123, 2, "k2", valueInstance{1, "v1"}}}},
+				Deltas: []delta{delta{Fix: false, P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 1, V: "v1"}}}},
 		},
 		{
 			"existing set, invalid (equal clock) update delta",
@@ -200,27 +200,25 @@ func TestStateMergeReceived(t *testing.T) {
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{2, "v2"},
+							"k1": &valueInstance{C: 2, V: "v2"},
 						},
-						clock:  2,
-						missed: map[int]bool{},
+						clock: 2,
 					}}},
 			//in
-			clusterState{Deltas: []delta{delta{false, 123, 3, "k2", valueInstance{2, "v2"}}}},
+			clusterState{Deltas: []delta{delta{Fix: false, P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 2, V: "v2"}}}},
 			//out
-			clusterState{Deltas: []delta{delta{false, 123, 2, "k2", valueInstance{2, "v2"}}}},
+			clusterState{Deltas: []delta{delta{Fix: false, P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 2, V: "v2"}}}},
 			//want
 			clusterState{
 				nodes: map[mesh.PeerName]*nodeState{
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{2, "v2"},
+							"k1": &valueInstance{C: 2, V: "v2"},
 						},
-						clock:  2,
-						missed: map[int]bool{},
+						clock: 2,
 					}},
-				Deltas: []delta{delta{false, 123, 2, "k2", valueInstance{2, "v2"}}}},
+				Deltas: []delta{delta{Fix: false, P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 2, V: "v2"}}}},
 		},
 		{
 			"existing set, valid (skipped clock) update delta (requests repair)",
@@ -232,17 +230,16 @@ func TestStateMergeReceived(t *testing.T) {
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{1, "v1"},
+							"k1": &valueInstance{C: 1, V: "v1"},
 						},
-						clock:  1,
-						missed: map[int]bool{},
+						clock: 1,
 					}}},
 			//in
-			clusterState{Deltas: []delta{delta{false, 123, 3, "k1", valueInstance{3, "v3"}}}},
+			clusterState{Deltas: []delta{delta{Fix: false, P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 3, V: "v3"}}}},
 			//out
 			clusterState{Deltas: []delta{
-				delta{true, 123, 3, "", valueInstance{2, ""}},
-				delta{false, 123, 2, "k1", valueInstance{3, "v3"}},
+				delta{Fix: true, P: 123, Ttl: 3, K: "", Vi: valueInstance{C: 2, V: ""}},
+				delta{Fix: false, P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 3, V: "v3"}},
 			}},
 			//want
 			clusterState{
@@ -250,14 +247,51 @@ func TestStateMergeReceived(t *testing.T) {
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{3, "v3"},
+							"k1": &valueInstance{C: 3, V: "v3"},
 						},
 						clock:  3,
-						missed: map[int]bool{2: true},
+						missed: [][2]int{{2, 2}},
+					}},
+				Deltas: []delta{
+					delta{Fix: true, P: 123, Ttl: 3, K: "", Vi: valueInstance{C: 2, V: ""}},
+					delta{Fix: false, P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 3, V: "v3"}},
+				}},
+		},
+		{
+			"existing set, coalesced update delta only requests clocks it does not cover",
+			//initial
+			clusterState{
+				logger: logger,
+				mtx:    &sync.RWMutex{},
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 1, V: "v1"},
+						},
+						clock: 1,
+					}}},
+			//in
+			clusterState{Deltas: []delta{delta{Fix: false, P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 4, V: "v4"}, Prior: []int{2}}}},
+			//out
+			clusterState{Deltas: []delta{
+				delta{Fix: true, P: 123, Ttl: 3, K: "", Vi: valueInstance{C: 3, V: ""}},
+				delta{Fix: false, P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 4, V: "v4"}, Prior: []int{2}},
+			}},
+			//want
+			clusterState{
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 4, V: "v4"},
+						},
+						clock:  4,
+						missed: [][2]int{{3, 3}},
 					}},
 				Deltas: []delta{
-					delta{true, 123, 3, "", valueInstance{2, ""}},
-					delta{false, 123, 2, "k1", valueInstance{3, "v3"}},
+					delta{Fix: true, P: 123, Ttl: 3, K: "", Vi: valueInstance{C: 3, V: ""}},
+					delta{Fix: false, P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 4, V: "v4"}, Prior: []int{2}},
 				}},
 		},
 		{
@@ -270,21 +304,20 @@ func TestStateMergeReceived(t *testing.T) {
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{1, "v1"},
+							"k1": &valueInstance{C: 1, V: "v1"},
 						},
-						clock:  1,
-						missed: map[int]bool{},
+						clock: 1,
 					}}},
 			//in
 			clusterState{Deltas: []delta{
-				delta{false, 123, 3, "k1", valueInstance{3, "v2"}},
-				delta{false, 123, 3, "k2", valueInstance{2, "v1"}},
+				delta{Fix: false, P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 3, V: "v2"}},
+				delta{Fix: false, P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 2, V: "v1"}},
 			}},
 			//out
 			clusterState{Deltas: []delta{
-				delta{true, 123, 3, "", valueInstance{2, ""}},
-				delta{false, 123, 2, "k1", valueInstance{3, "v2"}},
-				delta{false, 123, 2, "k2", valueInstance{2, "v1"}},
+				delta{Fix: true, P: 123, Ttl: 3, K: "", Vi: valueInstance{C: 2, V: ""}},
+				delta{Fix: false, P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 3, V: "v2"}},
+				delta{Fix: false, P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 2, V: "v1"}},
 			}},
 			//want
 			clusterState{
@@ -292,16 +325,141 @@ func TestStateMergeReceived(t *testing.T) {
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{3, "v2"},
-							"k2": &valueInstance{2, "v1"},
+							"k1": &valueInstance{C: 3, V: "v2"},
+							"k2": &valueInstance{C: 2, V: "v1"},
 						},
-						clock:  3,
-						missed: map[int]bool{2: false},
+						clock: 3,
+					}},
+				Deltas: []delta{
+					delta{Fix: true, P: 123, Ttl: 3, K: "", Vi: valueInstance{C: 2, V: ""}},
+					delta{Fix: false, P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 3, V: "v2"}},
+					delta{Fix: false, P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 2, V: "v1"}},
+				}},
+		},
+		{
+			"existing set, tombstone delta (no other peers, collected)",
+			//initial
+			clusterState{
+				logger: logger,
+				mtx:    &sync.RWMutex{},
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 1, V: "v1"},
+						},
+						clock: 1,
+					}}},
+			//in
+			clusterState{Deltas: []delta{delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 2, D: true}}}},
+			//out
+			clusterState{Deltas: []delta{
+				delta{P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 2, D: true}},
+				delta{Ack: true, P: 123, S: 0, Ttl: 3, K: "k1", Vi: valueInstance{C: 2}},
+			}},
+			//want
+			clusterState{
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self:  123,
+						set:   map[string]*valueInstance{},
+						clock: 2,
 					}},
 				Deltas: []delta{
-					delta{true, 123, 3, "", valueInstance{2, ""}},
-					delta{false, 123, 2, "k1", valueInstance{3, "v2"}},
-					delta{false, 123, 2, "k2", valueInstance{2, "v1"}},
+					delta{P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 2, D: true}},
+					delta{Ack: true, P: 123, S: 0, Ttl: 3, K: "k1", Vi: valueInstance{C: 2}},
+				}},
+		},
+		{
+			"existing set, tombstone delta followed by ack from remaining peer",
+			//initial
+			clusterState{
+				logger: logger,
+				mtx:    &sync.RWMutex{},
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 1, V: "v1"},
+						},
+						clock: 1,
+					},
+					124: &nodeState{
+						self:  124,
+						set:   map[string]*valueInstance{},
+						clock: 0,
+					}}},
+			//in
+			clusterState{Deltas: []delta{
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 2, D: true}},
+				delta{Ack: true, P: 123, S: 124, Ttl: 3, K: "k1", Vi: valueInstance{C: 2}},
+			}},
+			//out
+			clusterState{Deltas: []delta{
+				delta{P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 2, D: true}},
+				delta{Ack: true, P: 123, S: 0, Ttl: 3, K: "k1", Vi: valueInstance{C: 2}},
+				delta{Ack: true, P: 123, S: 124, Ttl: 2, K: "k1", Vi: valueInstance{C: 2}},
+			}},
+			//want
+			clusterState{
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self:  123,
+						set:   map[string]*valueInstance{},
+						clock: 2,
+					},
+					124: &nodeState{
+						self:  124,
+						set:   map[string]*valueInstance{},
+						clock: 0,
+					}},
+				Deltas: []delta{
+					delta{P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 2, D: true}},
+					delta{Ack: true, P: 123, S: 0, Ttl: 3, K: "k1", Vi: valueInstance{C: 2}},
+					delta{Ack: true, P: 123, S: 124, Ttl: 2, K: "k1", Vi: valueInstance{C: 2}},
+				}},
+		},
+		{
+			"existing set, update from restarted node (new incarnation)",
+			//initial
+			clusterState{
+				logger: logger,
+				mtx:    &sync.RWMutex{},
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self:        123,
+						incarnation: 1,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 5, V: "v5"},
+						},
+						clock:  5,
+						missed: [][2]int{{3, 3}},
+					}}},
+			//in
+			clusterState{Deltas: []delta{
+				delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 2, V: "v2"}, I: 2},
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 6, V: "v6"}, I: 1},
+			}},
+			//out
+			clusterState{Deltas: []delta{
+				delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 1}, I: 2},
+				delta{P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 2, V: "v2"}, I: 2},
+			}},
+			//want
+			clusterState{
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self:        123,
+						incarnation: 2,
+						set: map[string]*valueInstance{
+							"k2": &valueInstance{C: 2, V: "v2"},
+						},
+						clock:  2,
+						missed: [][2]int{{1, 1}},
+					}},
+				Deltas: []delta{
+					delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 1}, I: 2},
+					delta{P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 2, V: "v2"}, I: 2},
 				}},
 		},
 		{
@@ -314,17 +472,17 @@ func TestStateMergeReceived(t *testing.T) {
 			},
 			//in
 			clusterState{Deltas: []delta{
-				delta{true, 123, 3, "", valueInstance{2, ""}},
+				delta{Fix: true, P: 123, Ttl: 3, K: "", Vi: valueInstance{C: 2, V: ""}},
 			}},
 			//out
 			clusterState{Deltas: []delta{
-				delta{true, 123, 2, "", valueInstance{2, ""}},
+				delta{Fix: true, P: 123, Ttl: 2, K: "", Vi: valueInstance{C: 2, V: ""}},
 			},
 			},
 			//want
 			clusterState{
 				nodes:  map[mesh.PeerName]*nodeState{},
-				Deltas: []delta{delta{true, 123, 2, "", valueInstance{2, ""}}},
+				Deltas: []delta{delta{Fix: true, P: 123, Ttl: 2, K: "", Vi: valueInstance{C: 2, V: ""}}},
 			},
 		},
 		{
@@ -337,19 +495,58 @@ func TestStateMergeReceived(t *testing.T) {
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{3, "v3"},
-							"k2": &valueInstance{2, "v2"},
+							"k1": &valueInstance{C: 3, V: "v3"},
+							"k2": &valueInstance{C: 2, V: "v2"},
+						},
+						clock: 3,
+					}}},
+			//in
+			clusterState{Deltas: []delta{
+				delta{Fix: true, P: 123, Ttl: 3, K: "", Vi: valueInstance{C: 2, V: ""}},
+			}},
+			//out
+			clusterState{Deltas: []delta{
+				delta{Fix: false, P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 2, V: "v2"}},
+			}},
+			//want
+			clusterState{
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 3, V: "v3"},
+							"k2": &valueInstance{C: 2, V: "v2"},
+						},
+						clock: 3,
+					}},
+				Deltas: []delta{
+					delta{Fix: false, P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 2, V: "v2"}},
+				}},
+		},
+		{
+			"existing set, repair request (superseded)",
+			//initial
+			clusterState{
+				logger: logger,
+				mtx:    &sync.RWMutex{},
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 3, V: "v3"},
 						},
 						clock:  3,
-						missed: map[int]bool{},
+						missed: [][2]int{{1, 1}},
 					}}},
 			//in
 			clusterState{Deltas: []delta{
-				delta{true, 123, 3, "", valueInstance{2, ""}},
+				delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 2}},
+				delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 1}},
 			}},
 			//out
 			clusterState{Deltas: []delta{
-				delta{false, 123, 3, "k2", valueInstance{2, "v2"}},
+				delta{Sup: true, P: 123, Ttl: 3, Vi: valueInstance{C: 2}},
+				delta{Fix: true, P: 123, Ttl: 2, Vi: valueInstance{C: 1}},
 			}},
 			//want
 			clusterState{
@@ -357,14 +554,99 @@ func TestStateMergeReceived(t *testing.T) {
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{3, "v3"},
-							"k2": &valueInstance{2, "v2"},
+							"k1": &valueInstance{C: 3, V: "v3"},
+						},
+						clock:  3,
+						missed: [][2]int{{1, 1}},
+					}},
+				Deltas: []delta{
+					delta{Sup: true, P: 123, Ttl: 3, Vi: valueInstance{C: 2}},
+					delta{Fix: true, P: 123, Ttl: 2, Vi: valueInstance{C: 1}},
+				}},
+		},
+		{
+			"existing set, superseded response closes missed clock",
+			//initial
+			clusterState{
+				logger: logger,
+				mtx:    &sync.RWMutex{},
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 3, V: "v3"},
 						},
 						clock:  3,
-						missed: map[int]bool{},
+						missed: [][2]int{{2, 2}},
+					}}},
+			//in
+			clusterState{Deltas: []delta{
+				delta{Sup: true, P: 123, Ttl: 3, Vi: valueInstance{C: 2}},
+			}},
+			//out
+			clusterState{Deltas: []delta{
+				delta{Sup: true, P: 123, Ttl: 2, Vi: valueInstance{C: 2}},
+			}},
+			//want
+			clusterState{
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 3, V: "v3"},
+						},
+						clock: 3,
+					}},
+				Deltas: []delta{
+					delta{Sup: true, P: 123, Ttl: 2, Vi: valueInstance{C: 2}},
+				}},
+		},
+		{
+			"existing set, range repair request",
+			//initial
+			clusterState{
+				logger: logger,
+				mtx:    &sync.RWMutex{},
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 4, V: "v4"},
+							"k2": &valueInstance{C: 6, V: "v6"},
+						},
+						clock:  6,
+						missed: [][2]int{{5, 5}},
+					}}},
+			//in
+			clusterState{Deltas: []delta{
+				delta{Fix: true, P: 123, Ttl: 3, Vi: valueInstance{C: 2}, To: 8},
+				delta{Sup: true, P: 123, Ttl: 1, Vi: valueInstance{C: 5}, To: 7},
+			}},
+			//out
+			clusterState{Deltas: []delta{
+				delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 4, V: "v4"}},
+				delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 6, V: "v6"}},
+				delta{Sup: true, P: 123, Ttl: 3, Vi: valueInstance{C: 2}, To: 3},
+				delta{Fix: true, P: 123, Ttl: 2, Vi: valueInstance{C: 5}},
+				delta{Fix: true, P: 123, Ttl: 2, Vi: valueInstance{C: 7}, To: 8},
+			}},
+			//want
+			clusterState{
+				nodes: map[mesh.PeerName]*nodeState{
+					123: &nodeState{
+						self: 123,
+						set: map[string]*valueInstance{
+							"k1": &valueInstance{C: 4, V: "v4"},
+							"k2": &valueInstance{C: 6, V: "v6"},
+						},
+						clock: 6,
 					}},
 				Deltas: []delta{
-					delta{false, 123, 3, "k2", valueInstance{2, "v2"}},
+					delta{P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 4, V: "v4"}},
+					delta{P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 6, V: "v6"}},
+					delta{Sup: true, P: 123, Ttl: 3, Vi: valueInstance{C: 2}, To: 3},
+					delta{Fix: true, P: 123, Ttl: 2, Vi: valueInstance{C: 5}},
+					delta{Fix: true, P: 123, Ttl: 2, Vi: valueInstance{C: 7}, To: 8},
 				}},
 		},
 		{
@@ -377,29 +659,25 @@ func TestStateMergeReceived(t *testing.T) {
 			},
 			//in
 			clusterState{Deltas: []delta{
-				delta{false, 123, 1, "k1", valueInstance{1, "v1"}},
-				delta{true, 123, 3, "", valueInstance{2, ""}},
-				delta{true, 124, 3, "", valueInstance{1, ""}},
-				delta{true, 123, 3, "", valueInstance{1, ""}},
-				delta{false, 123, 3, "k1", valueInstance{2, "v2"}},
-				delta{false, 123, 2, "k1", valueInstance{3, "v3"}},
-				delta{false, 123, 1, "k1", valueInstance{4, "v4"}},
-				delta{false, 123, 1, "k1", valueInstance{7, "v5"}},
-				delta{false, 123, 1, "k2", valueInstance{6, "v2"}},
-				delta{false, 123, 2, "k2", valueInstance{5, "v1"}},
-				delta{false, 123, 3, "k2", valueInstance{5, "v1"}},
+				delta{Fix: false, P: 123, Ttl: 1, K: "k1", Vi: valueInstance{C: 1, V: "v1"}},
+				delta{Fix: true, P: 123, Ttl: 3, K: "", Vi: valueInstance{C: 2, V: ""}},
+				delta{Fix: true, P: 124, Ttl: 3, K: "", Vi: valueInstance{C: 1, V: ""}},
+				delta{Fix: true, P: 123, Ttl: 3, K: "", Vi: valueInstance{C: 1, V: ""}},
+				delta{Fix: false, P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 2, V: "v2"}},
+				delta{Fix: false, P: 123, Ttl: 2, K: "k1", Vi: valueInstance{C: 3, V: "v3"}},
+				delta{Fix: false, P: 123, Ttl: 1, K: "k1", Vi: valueInstance{C: 4, V: "v4"}},
+				delta{Fix: false, P: 123, Ttl: 1, K: "k1", Vi: valueInstance{C: 7, V: "v5"}},
+				delta{Fix: false, P: 123, Ttl: 1, K: "k2", Vi: valueInstance{C: 6, V: "v2"}},
+				delta{Fix: false, P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 5, V: "v1"}},
+				delta{Fix: false, P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 5, V: "v1"}},
 			}},
 			//out
 			clusterState{Deltas: []delta{
-				delta{true, 123, 2, "", valueInstance{2, ""}},
-				delta{true, 124, 2, "", valueInstance{1, ""}},
-				delta{false, 123, 3, "k1", valueInstance{1, "v1"}},
-				delta{false, 123, 2, "k1", valueInstance{2, "v2"}},
-				delta{false, 123, 1, "k1", valueInstance{3, "v3"}},
-				delta{true, 123, 3, "", valueInstance{5, ""}},
-				delta{true, 123, 3, "", valueInstance{6, ""}},
-				delta{false, 123, 1, "k2", valueInstance{5, "v1"}},
-				delta{false, 123, 2, "k2", valueInstance{5, "v1"}},
+				delta{Fix: true, P: 123, Ttl: 2, K: "", Vi: valueInstance{C: 2, V: ""}},
+				delta{Fix: true, P: 124, Ttl: 2, K: "", Vi: valueInstance{C: 1, V: ""}},
+				delta{Fix: false, P: 123, Ttl: 1, K: "k1", Vi: valueInstance{C: 3, V: "v3"}, Prior: []int{1, 2}},
+				delta{Fix: true, P: 123, Ttl: 3, K: "", Vi: valueInstance{C: 5, V: ""}, To: 6},
+				delta{Fix: false, P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 5, V: "v1"}},
 			}},
 			//want
 			clusterState{
@@ -407,22 +685,17 @@ func TestStateMergeReceived(t *testing.T) {
 					123: &nodeState{
 						self: 123,
 						set: map[string]*valueInstance{
-							"k1": &valueInstance{7, "v5"},
-							"k2": &valueInstance{6, "v2"},
+							"k1": &valueInstance{C: 7, V: "v5"},
+							"k2": &valueInstance{C: 6, V: "v2"},
 						},
-						clock:  7,
-						missed: map[int]bool{5: false, 6: false},
+						clock: 7,
 					}},
 				Deltas: []delta{
-					delta{true, 123, 2, "", valueInstance{2, ""}},
-					delta{true, 124, 2, "", valueInstance{1, ""}},
-					delta{false, 123, 3, "k1", valueInstance{1, "v1"}},
-					delta{false, 123, 2, "k1", valueInstance{2, "v2"}},
-					delta{false, 123, 1, "k1", valueInstance{3, "v3"}},
-					delta{true, 123, 3, "", valueInstance{5, ""}},
-					delta{true, 123, 3, "", valueInstance{6, ""}},
-					delta{false, 123, 1, "k2", valueInstance{5, "v1"}},
-					delta{false, 123, 2, "k2", valueInstance{5, "v1"}},
+					delta{Fix: true, P: 123, Ttl: 2, K: "", Vi: valueInstance{C: 2, V: ""}},
+					delta{Fix: true, P: 124, Ttl: 2, K: "", Vi: valueInstance{C: 1, V: ""}},
+					delta{Fix: false, P: 123, Ttl: 1, K: "k1", Vi: valueInstance{C: 3, V: "v3"}, Prior: []int{1, 2}},
+					delta{Fix: true, P: 123, Ttl: 3, K: "", Vi: valueInstance{C: 5, V: ""}, To: 6},
+					delta{Fix: false, P: 123, Ttl: 2, K: "k2", Vi: valueInstance{C: 5, V: "v1"}},
 				},
 			},
 		},
@@ -462,7 +735,7 @@ func TestStateEncode(t *testing.T) {
 			"single update delta",
 			//initial
 			clusterState{logger: logger, mtx: &sync.RWMutex{}, Deltas: []delta{
-				delta{false, 123, 3, "k1", valueInstance{1, "v1"}},
+				delta{Fix: false, P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 1, V: "v1"}},
 			}},
 			//expected
 			"{\"Deltas\":[{\"Fix\":false,\"P\":123,\"Ttl\":3,\"K\":\"k1\",\"Vi\":{\"C\":1,\"V\":\"v1\"}}]}",
@@ -471,8 +744,8 @@ func TestStateEncode(t *testing.T) {
 			"double update delta",
 			//initial
 			clusterState{logger: logger, mtx: &sync.RWMutex{}, Deltas: []delta{
-				delta{false, 123, 3, "k1", valueInstance{1, "v1"}},
-				delta{false, 123, 3, "k2", valueInstance{2, "v1"}},
+				delta{Fix: false, P: 123, Ttl: 3, K: "k1", Vi: valueInstance{C: 1, V: "v1"}},
+				delta{Fix: false, P: 123, Ttl: 3, K: "k2", Vi: valueInstance{C: 2, V: "v1"}},
 			}},
 			//expected
 			"{\"Deltas\":[{\"Fix\":false,\"P\":123,\"Ttl\":3,\"K\":\"k1\",\"Vi\":{\"C\":1,\"V\":\"v1\"}},{\"Fix\":false,\"P\":123,\"Ttl\":3,\"K\":\"k2\",\"Vi\":{\"C\":2,\"V\":\"v1\"}}]}",
@@ -486,5 +759,194 @@ func TestStateEncode(t *testing.T) {
 		} else {
 			t.Logf("Passed test for: %s (Encode() output)", tc.description)
 		}
+		// mesh encodes the same batch for every connection
+		if again := tc.initial.Encode(); !reflect.DeepEqual(o, again) {
+			t.Errorf("Failed test for: %s (Encode() repeated)", tc.description)
+			t.Errorf("Check Encode() failed:\nWanted: %s\nGot: %s", o, again)
+		} else {
+			t.Logf("Passed test for: %s (Encode() repeated)", tc.description)
+		}
+	}
+}
+
+func TestStateExpire(t *testing.T) {
+	logger := log.New(os.Stdout, "TEST ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	now := time.Now()
+
+	cs := clusterState{
+		logger: logger,
+		mtx:    &sync.RWMutex{},
+		nodes: map[mesh.PeerName]*nodeState{
+			123: &nodeState{
+				self: 123,
+				set: map[string]*valueInstance{
+					"k1": &valueInstance{C: 1, V: "v1"},
+					"k2": &valueInstance{C: 2, V: "v2", E: now.Add(-time.Second).UnixNano()},
+					"k3": &valueInstance{C: 3, V: "v3", E: now.Add(time.Hour).UnixNano()},
+				},
+				clock: 3,
+			}}}
+
+	if _, err := cs.Get(123, "k2"); err == nil {
+		t.Errorf("Get() returned expired key k2")
+	}
+	cs.expire(now)
+	for k, want := range map[string]bool{"k1": true, "k2": false, "k3": true} {
+		if _, got := cs.nodes[123].set[k]; got != want {
+			t.Errorf("Check expire() failed for %s: wanted present=%v, got %v", k, want, got)
+		}
+	}
+}
+
+func TestNodeStateLog(t *testing.T) {
+	ns := &nodeState{
+		self: 123,
+		set: map[string]*valueInstance{
+			"k1": &valueInstance{C: 1, V: "v1"},
+			"k2": &valueInstance{C: 2, V: "v2"},
+		},
+		clock: 2,
+	}
+	ns.put("k1", &valueInstance{C: 3, V: "v3"})
+	ns.put("k3", &valueInstance{C: 4, V: "v4"})
+	ns.remove("k2")
+
+	for _, tc := range []struct {
+		clock int
+		key   string
+	}{
+		{1, ""},
+		{2, ""},
+		{3, "k1"},
+		{4, "k3"},
+		{5, ""},
+	} {
+		k, vi := ns.at(tc.clock)
+		if k != tc.key || (vi == nil) != (tc.key == "") || (vi != nil && vi.C != tc.clock) {
+			t.Errorf("Check at(%v) failed:\nWanted: %q\nGot: %q %v", tc.clock, tc.key, k, vi)
+		}
+	}
+	if len(ns.log) != 2 {
+		t.Errorf("Check log failed: wanted 2 entries, got %v", ns.log)
+	}
+}
+
+func TestStateEncodeFrames(t *testing.T) {
+	logger := log.New(os.Stdout, "TEST ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	var deltas []delta
+	set := map[string]valueInstance{}
+	for i := 1; i <= 100; i++ {
+		k := fmt.Sprintf("k%v", i)
+		deltas = append(deltas, delta{P: 123, Ttl: 3, K: k, Vi: valueInstance{C: i, V: "v"}})
+		set[k] = valueInstance{C: i, V: "v"}
+	}
+
+	for _, tc := range []struct {
+		description string
+		codec       Codec
+		maxFrame    int
+		in          clusterState
+		frames      int
+	}{
+		{"small burst, single frame", JSONCodec, 0, clusterState{Deltas: deltas[:2]}, 1},
+		{"large burst, json", JSONCodec, 1024, clusterState{Deltas: deltas}, 8},
+		{"large burst, binary", BinaryCodec, 256, clusterState{Deltas: deltas}, 8},
+		{"large snapshot and deltas", JSONCodec, 1024, clusterState{
+			Deltas: deltas[:10],
+			States: map[mesh.PeerName]*nodeSnapshot{
+				123: &nodeSnapshot{Clock: 100, Set: set},
+				124: &nodeSnapshot{Clock: 1},
+			}}, 4},
+		{"oversized delta", JSONCodec, 16, clusterState{Deltas: deltas[:1]}, 1},
+	} {
+		cs := tc.in
+		cs.logger, cs.mtx, cs.codec, cs.maxFrame = logger, &sync.RWMutex{}, tc.codec, tc.maxFrame
+		frames := cs.Encode()
+		got := clusterState{}
+		for _, f := range frames {
+			if tc.maxFrame > 0 && len(f) > tc.maxFrame && len(frames) > 1 {
+				t.Errorf("Failed test for: %s (frame of %v bytes)", tc.description, len(f))
+			}
+			part := clusterState{}
+			if err := decode(f, &part); err != nil {
+				t.Fatalf("%s: decode: %v", tc.description, err)
+			}
+			got.Deltas = append(got.Deltas, part.Deltas...)
+			got.mergeSnapshots(part.States)
+		}
+		if len(frames) < tc.frames {
+			t.Errorf("Failed test for: %s (wanted at least %v frames, got %v)", tc.description, tc.frames, len(frames))
+		}
+		if !reflect.DeepEqual(got.Deltas, tc.in.Deltas) || len(got.States) != len(tc.in.States) ||
+			(len(tc.in.States) > 0 && (got.States[123].partial() || !reflect.DeepEqual(got.States[123].Set, set))) {
+			t.Errorf("Failed test for: %s (frames do not reassemble)", tc.description)
+		} else {
+			t.Logf("Passed test for: %s (%v frames)", tc.description, len(frames))
+		}
+	}
+}
+
+func TestStateTombstoneMembers(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	cs := newClusterState(1, logger)
+	// peers that have never written are members all the same
+	cs.setPeers(map[mesh.PeerName]bool{2: true, 3: true}, nil)
+	cs.Set("k1", "v1")
+	cs.Delete("k1")
+	c := cs.nodes[1].set["k1"].C
+
+	for _, tc := range []struct {
+		description string
+		op          func()
+		kept        bool
+	}{
+		{"no acks", func() {}, true},
+		{"ack from one member", func() {
+			cs.Merge(&clusterState{Deltas: []delta{delta{Ack: true, P: 1, S: 2, Ttl: 1, K: "k1", Vi: valueInstance{C: c}, I: cs.nodes[1].incarnation}}})
+		}, true},
+		{"the other member leaves", func() {
+			cs.setPeers(map[mesh.PeerName]bool{2: true}, nil)
+		}, false},
+	} {
+		tc.op()
+		if kept := cs.nodes[1].set["k1"] != nil; kept != tc.kept {
+			t.Errorf("Failed test for: %s (collectTombstone())", tc.description)
+			t.Errorf("Check collectTombstone() failed:\nWanted kept: %v\nGot: %v", tc.kept, kept)
+		} else {
+			t.Logf("Passed test for: %s (collectTombstone())", tc.description)
+		}
+	}
+	// a relayed ack arriving after collection is not kept
+	cs.Merge(&clusterState{Deltas: []delta{delta{Ack: true, P: 1, S: 2, Ttl: 1, K: "k1", Vi: valueInstance{C: c}, I: cs.nodes[1].incarnation}}})
+	if len(cs.nodes[1].acks) != 0 {
+		t.Errorf("Check acks failed: late ack kept: %v", cs.nodes[1].acks)
+	}
+}
+
+func TestStateOutliveIncarnation(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	for _, tc := range []struct {
+		description string
+		in          clusterState
+	}{
+		{"snapshot of a later life", clusterState{States: map[mesh.PeerName]*nodeSnapshot{
+			1: &nodeSnapshot{Incarnation: 9, Clock: 4},
+		}}},
+		{"delta from a later life", clusterState{Deltas: []delta{
+			delta{P: 1, Ttl: 1, K: "k9", Vi: valueInstance{C: 4, V: "v4"}, I: 9},
+		}}},
+	} {
+		cs := newClusterState(1, logger)
+		cs.nodes[1].incarnation = 5
+		cs.Set("k1", "v1")
+		cs.Merge(&clusterState{States: map[mesh.PeerName]*nodeSnapshot{
+			1: &nodeSnapshot{Incarnation: 3, Clock: 7},
+		}})
+		cs.Merge(&tc.in)
+		if ns := cs.nodes[1]; ns.incarnation != 10 || ns.set["k9"] != nil || cs.Deltas[0].I != 10 {
+			t.Errorf("Failed test for: %s (incarnation %v, deltas %s)", tc.description, ns.incarnation, spew.Sdump(cs.Deltas))
+		} else {
+			t.Logf("Passed test for: %s (incarnation)", tc.description)
+		}
 	}
 }
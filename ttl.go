@@ -0,0 +1,79 @@
+package gkv
+
+import (
+	"math/bits"
+)
+
+// DefaultTTL is the hop count given to deltas when TTLPolicy leaves it unset.
+const DefaultTTL = 3
+
+// TTLPolicy sets how many hops each kind of delta we originate travels
+// before peers stop forwarding it. Zero fields default to DefaultTTL.
+type TTLPolicy struct {
+	// Update is for our own writes and deletions.
+	Update int
+	// Repair is for answers to repair requests.
+	Repair int
+	// Request is for repair requests, when we notice missed deltas.
+	Request int
+	// Ack is for tombstone acknowledgements.
+	Ack int
+	// Adaptive derives every hop count from the size of the cluster
+	// instead, so large clusters still see every delta. Any field set
+	// above acts as a floor.
+	Adaptive bool
+}
+
+// ttlOp is a kind of delta with its own hop count.
+type ttlOp int
+
+const (
+	ttlUpdate ttlOp = iota
+	ttlRepair
+	ttlRequest
+	ttlAck
+)
+
+// ttl returns the hop count for a new delta of kind op.
+// Must be called with the lock held.
+func (cs *clusterState) ttl(op ttlOp) int {
+	var ttl int
+	switch op {
+	case ttlUpdate:
+		ttl = cs.ttls.Update
+	case ttlRepair:
+		ttl = cs.ttls.Repair
+	case ttlRequest:
+		ttl = cs.ttls.Request
+	case ttlAck:
+		ttl = cs.ttls.Ack
+	}
+	if cs.ttls.Adaptive {
+		if a := adaptiveTTL(cs.clusterSize()); a > ttl {
+			ttl = a
+		}
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return ttl
+}
+
+// clusterSize returns how many peers are in the mesh, as last reported
+// by setPeers, or else how many nodes we hold state for.
+// Must be called with the lock held.
+func (cs *clusterState) clusterSize() int {
+	if cs.size > len(cs.nodes) {
+		return cs.size
+	}
+	return len(cs.nodes)
+}
+
+// adaptiveTTL is enough hops for a delta forwarded by every peer to
+// reach a cluster of n peers: one more than log2 of n, rounded up.
+func adaptiveTTL(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return bits.Len(uint(n-1)) + 1
+}
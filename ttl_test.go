@@ -0,0 +1,74 @@
+package gkv
+
+import (
+	"testing"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestStateTTL(t *testing.T) {
+	for _, tc := range []struct {
+		description string
+		ttls        TTLPolicy
+		nodes       int
+		size        int
+		op          ttlOp
+		want        int
+	}{
+		{
+			"unset defaults",
+			TTLPolicy{},
+			1, 0,
+			ttlUpdate,
+			DefaultTTL,
+		},
+		{
+			"per operation",
+			TTLPolicy{Update: 5, Repair: 2},
+			1, 0,
+			ttlRepair,
+			2,
+		},
+		{
+			"adaptive, small cluster",
+			TTLPolicy{Adaptive: true},
+			2, 0,
+			ttlUpdate,
+			2,
+		},
+		{
+			"adaptive, known nodes",
+			TTLPolicy{Adaptive: true},
+			20, 0,
+			ttlUpdate,
+			6,
+		},
+		{
+			"adaptive, mesh size",
+			TTLPolicy{Adaptive: true},
+			2, 100,
+			ttlRequest,
+			8,
+		},
+		{
+			"adaptive, floor",
+			TTLPolicy{Ack: 10, Adaptive: true},
+			2, 100,
+			ttlAck,
+			10,
+		},
+	} {
+		cs := newClusterState(123, nil)
+		cs.ttls = tc.ttls
+		cs.size = tc.size
+		for i := 1; i < tc.nodes; i++ {
+			cs.nodes[mesh.PeerName(123+i)] = newNodeState(mesh.PeerName(123+i), 0)
+		}
+		if got := cs.ttl(tc.op); got != tc.want {
+			t.Errorf("Failed test for: %s (ttl())", tc.description)
+			t.Errorf("Check ttl() failed:\nWanted: %d\nGot: %d", tc.want, got)
+		} else {
+			t.Logf("Passed test for: %s (ttl())", tc.description)
+		}
+	}
+}
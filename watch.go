@@ -0,0 +1,130 @@
+package gkv
+
+import (
+	"context"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+)
+
+// watchBuffer is how many events a watcher may fall behind by before
+// further events are dropped.
+const watchBuffer = 64
+
+// EventType describes what caused an Event.
+type EventType int
+
+const (
+	// EventSet is a new value written by its owner.
+	EventSet EventType = iota
+	// EventRepair is a value recovered after a missed delta.
+	EventRepair
+	// EventDelete is a key deleted by its owner.
+	EventDelete
+	// EventExpire is a value that reached its expiry.
+	EventExpire
+	// EventAbandon is a run of missed clocks, starting at Clock, given up
+	// on after repeated repair requests. Its Key is empty.
+	EventAbandon
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventRepair:
+		return "repair"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	case EventAbandon:
+		return "abandon"
+	}
+	return "unknown"
+}
+
+// Event describes a change to a key owned by Peer.
+type Event struct {
+	Type  EventType
+	Peer  mesh.PeerName
+	Key   string
+	Old   string
+	New   string
+	Clock int
+}
+
+type watcher struct {
+	node   mesh.PeerName
+	prefix string
+	ch     chan Event
+}
+
+// Watch returns a channel of changes to keys starting with keyPrefix that
+// are owned by node, or by any node if node is mesh.UnknownPeerName.
+// The channel is closed once ctx is done. Events are dropped rather than
+// blocking if the receiver falls behind.
+func (cs *clusterState) Watch(ctx context.Context, node mesh.PeerName, keyPrefix string) <-chan Event {
+	w := &watcher{
+		node:   node,
+		prefix: keyPrefix,
+		ch:     make(chan Event, watchBuffer),
+	}
+	// get write lock
+	cs.mtx.Lock()
+	cs.watchers = append(cs.watchers, w)
+	cs.mtx.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		// get write lock
+		cs.mtx.Lock()
+		defer cs.mtx.Unlock()
+		for i, o := range cs.watchers {
+			if o == w {
+				cs.watchers = append(cs.watchers[:i], cs.watchers[i+1:]...)
+				break
+			}
+		}
+		close(w.ch)
+	}()
+	return w.ch
+}
+
+// notify tells interested watchers that key, owned by node, changed from
+// old to new. Either may be nil. Must be called with the write lock held.
+func (cs *clusterState) notify(t EventType, node mesh.PeerName, key string, old, new *valueInstance) {
+	if len(cs.watchers) == 0 || internal(key) {
+		return
+	}
+	e := Event{
+		Type: t,
+		Peer: node,
+		Key:  key,
+	}
+	if old != nil && !old.D {
+		e.Old = old.V
+	}
+	if new != nil {
+		e.Clock = new.C
+		if !new.D {
+			e.New = new.V
+		}
+	}
+	cs.publish(e)
+}
+
+// publish sends e to interested watchers without blocking.
+// Must be called with the write lock held.
+func (cs *clusterState) publish(e Event) {
+	for _, w := range cs.watchers {
+		if (w.node != mesh.UnknownPeerName && w.node != e.Peer) || !strings.HasPrefix(e.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- e:
+		default:
+			cs.logger.Printf("Watcher too slow, dropped %v event: %v->%v", e.Type, e.Peer, e.Key)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package gkv
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestStateWatch(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	cs := newClusterState(1, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	all := cs.Watch(ctx, mesh.UnknownPeerName, "")
+	remote := cs.Watch(ctx, 123, "a/")
+
+	cs.Set("a/k1", "v1")
+	cs.Set("a/k1", "v2")
+	cs.Delete("a/k1")
+	cs.Merge(&clusterState{Deltas: []delta{
+		delta{P: 123, Ttl: 3, K: "a/k1", Vi: valueInstance{C: 1, V: "v1"}},
+		delta{P: 123, Ttl: 3, K: "b/k1", Vi: valueInstance{C: 3, V: "v3"}},
+		delta{P: 123, Ttl: 3, K: "a/k2", Vi: valueInstance{C: 2, V: "v2"}},
+	}})
+	cancel()
+
+	for _, tc := range []struct {
+		description string
+		ch          <-chan Event
+		want        []Event
+	}{
+		{
+			"all nodes, all keys",
+			all,
+			[]Event{
+				Event{EventSet, 1, "a/k1", "", "v1", 1},
+				Event{EventSet, 1, "a/k1", "v1", "v2", 2},
+				Event{EventDelete, 1, "a/k1", "v2", "", 3},
+				Event{EventSet, 123, "a/k1", "", "v1", 1},
+				Event{EventSet, 123, "b/k1", "", "v3", 3},
+				Event{EventRepair, 123, "a/k2", "", "v2", 2},
+			},
+		},
+		{
+			"single node, key prefix",
+			remote,
+			[]Event{
+				Event{EventSet, 123, "a/k1", "", "v1", 1},
+				Event{EventRepair, 123, "a/k2", "", "v2", 2},
+			},
+		},
+	} {
+		var got []Event
+		for e := range tc.ch {
+			got = append(got, e)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Failed test for: %s (Watch() events)", tc.description)
+			t.Errorf("Check Watch() failed:\nWanted: %v\nGot: %v", tc.want, got)
+		}
+	}
+}